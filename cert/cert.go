@@ -0,0 +1,70 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DefaultDir = "/etc/webhook/certs" // tls.crt 和 tls.key 采用secret的方式挂载到此目录
+	CertName   = "tls.crt"
+	KeyName    = "tls.key"
+)
+
+var (
+	CertFile = filepath.Join(DefaultDir, CertName)
+	KeyFile  = filepath.Join(DefaultDir, KeyName)
+)
+
+// LoadKeyPair 加载证书和私钥，并解析出证书本身
+func LoadKeyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyPair(certPEM, keyPEM)
+}
+
+func parseKeyPair(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	pair.Leaf = leaf
+	return &pair, nil
+}
+
+// CheckValidity 检查证书是否在有效期内
+func CheckValidity(pair *tls.Certificate, now time.Time) error {
+	if now.Before(pair.Leaf.NotBefore) {
+		return fmt.Errorf("certificate %s is not valid before %s", pair.Leaf.Subject.CommonName, pair.Leaf.NotBefore)
+	}
+	if now.After(pair.Leaf.NotAfter) {
+		return fmt.Errorf("certificate %s expired at %s", pair.Leaf.Subject.CommonName, pair.Leaf.NotAfter)
+	}
+	return nil
+}
+
+// Ready 检查当前使用的证书和私钥可以加载并且未过期
+func Ready() error {
+	if watcher != nil {
+		return CheckValidity(watcher.Current(), time.Now())
+	}
+	pair, err := LoadKeyPair(CertFile, KeyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair %s %s error: %v", CertFile, KeyFile, err)
+	}
+	return CheckValidity(pair, time.Now())
+}
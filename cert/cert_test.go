@@ -0,0 +1,90 @@
+package cert
+
+import (
+	"io/ioutil"
+	certutil "k8s.io/client-go/util/cert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeKeyPair(t *testing.T, dir string) (string, string) {
+	certPEM, keyPEM, err := certutil.GenerateSelfSignedCertKey("king-preset.kingfisher-system.svc", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, CertName), filepath.Join(dir, KeyName)
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "king-preset-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(c, k string) { CertFile, KeyFile = c, k }(CertFile, KeyFile)
+
+	CertFile, KeyFile = filepath.Join(dir, CertName), filepath.Join(dir, KeyName)
+	if err := Ready(); err == nil {
+		t.Error("missing key pair should not be ready")
+	}
+
+	CertFile, KeyFile = writeKeyPair(t, dir)
+	if err := Ready(); err != nil {
+		t.Errorf("valid key pair should be ready: %v", err)
+	}
+
+	pair, err := LoadKeyPair(CertFile, KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckValidity(pair, pair.Leaf.NotAfter.Add(time.Hour)); err == nil {
+		t.Error("expired certificate should fail validity check")
+	}
+}
+
+func TestWatcherReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "king-preset-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { watcher = nil }()
+
+	certFile, keyFile := writeKeyPair(t, dir)
+	w, err := NewWatcher(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := w.Current()
+	if changed, err := w.reload(); err != nil || changed {
+		t.Errorf("unchanged files: changed=%v err=%v, want no reload", changed, err)
+	}
+
+	writeKeyPair(t, dir)
+	if changed, err := w.reload(); err != nil || !changed {
+		t.Fatalf("rotated files: changed=%v err=%v, want reload", changed, err)
+	}
+	if w.Current() == first {
+		t.Error("certificate was not swapped after rotation")
+	}
+
+	second := w.Current()
+	if err := ioutil.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.reload(); err == nil {
+		t.Error("broken certificate should fail to reload")
+	}
+	if w.Current() != second {
+		t.Error("broken certificate should keep the previous one")
+	}
+}
@@ -0,0 +1,126 @@
+package cert
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	CACommonName    = "Admission Controller Webhook Kingfisher"
+	CAValidity      = 10 * 365 * 24 * time.Hour
+	ServingValidity = 365 * 24 * time.Hour
+	rsaKeySize      = 2048
+)
+
+// GenerateCA 生成自签名CA证书和私钥，PEM格式
+func GenerateCA(now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, rsaKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: CACommonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeCert(der), encodeKey(key), nil
+}
+
+// GenerateServingCert 使用CA签发Webhook服务证书，dnsNames中第一个作为CommonName
+func GenerateServingCert(caCertPEM, caKeyPEM []byte, dnsNames []string, now time.Time) (certPEM, keyPEM []byte, err error) {
+	ca, err := parseCA(caCertPEM, caKeyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, rsaKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(ServingValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeCert(der), encodeKey(key), nil
+}
+
+// VerifyServingCert 检查服务证书由CA签发，包含所有dnsNames，并且在renewBefore之后仍然有效
+func VerifyServingCert(caCertPEM, certPEM, keyPEM []byte, dnsNames []string, now time.Time, renewBefore time.Duration) error {
+	pair, err := parseKeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caCertPEM) {
+		return fmt.Errorf("no CA certificate found")
+	}
+	for _, name := range dnsNames {
+		if _, err := pair.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots, CurrentTime: now}); err != nil {
+			return err
+		}
+	}
+	return CheckValidity(pair, now.Add(renewBefore))
+}
+
+// VerifyCA 检查CA证书和私钥匹配，并且在renewBefore之后仍然有效
+func VerifyCA(caCertPEM, caKeyPEM []byte, now time.Time, renewBefore time.Duration) error {
+	ca, err := parseCA(caCertPEM, caKeyPEM)
+	if err != nil {
+		return err
+	}
+	return CheckValidity(ca, now.Add(renewBefore))
+}
+
+func parseCA(caCertPEM, caKeyPEM []byte) (*tls.Certificate, error) {
+	ca, err := parseKeyPair(caCertPEM, caKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("parse CA error: %v", err)
+	}
+	if !ca.Leaf.IsCA {
+		return nil, fmt.Errorf("certificate %s is not a CA", ca.Leaf.Subject.CommonName)
+	}
+	return ca, nil
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func encodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func encodeKey(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
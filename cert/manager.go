@@ -0,0 +1,303 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	CACertName = "ca.crt"
+	CAKeyName  = "ca.key"
+	// 自签名证书写入的本地目录，secret挂载目录为只读
+	SelfSignedDir = "/tmp/king-preset/certs"
+	// 服务证书剩余有效期不足RenewBefore时重新签发，CA剩余有效期不足CARenewBefore时重新生成
+	RenewBefore   = 30 * 24 * time.Hour
+	CARenewBefore = 365 * 24 * time.Hour
+	// 检查证书是否需要更新的周期
+	RenewInterval = time.Hour
+	// CA重新生成后旧CA继续保留在caBundle中的时间，其他副本在下一次检查前仍使用旧CA签发的服务证书，需要覆盖一个完整的检查周期
+	CAOverlap = 2 * RenewInterval
+	// Secret中保存旧CA证书和CA重新生成时间的key
+	PreviousCACertName = "ca-previous.crt"
+	CARotatedAtName    = "ca-rotated-at"
+	// 自签名证书Secret的标签，只更新带有此标签的Secret，避免覆盖部署时创建的证书
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedBy      = "king-preset"
+)
+
+// Options 自签名证书的相关配置
+type Options struct {
+	Service           string // Webhook的Service名称
+	Namespace         string // Webhook所在的命名空间，Secret也保存在此命名空间
+	SecretName        string // 保存CA和服务证书的Secret
+	WebhookConfigName string // 需要更新caBundle的Mutating/ValidatingWebhookConfiguration名称
+	Dir               string // 服务证书写入的本地目录
+}
+
+// DNSNames 服务证书需要包含的域名
+func (o Options) DNSNames() []string {
+	return []string{
+		fmt.Sprintf("%s.%s.svc", o.Service, o.Namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", o.Service, o.Namespace),
+		fmt.Sprintf("%s.%s", o.Service, o.Namespace),
+		o.Service,
+	}
+}
+
+// Manager 生成并维护自签名CA和服务证书，保存在Secret中，并更新Webhook配置的caBundle
+type Manager struct {
+	client   kubernetes.Interface
+	opts     Options
+	caBundle []byte
+}
+
+func NewManager(client kubernetes.Interface, opts Options) *Manager {
+	return &Manager{client: client, opts: opts}
+}
+
+// CertFile 服务证书的本地路径
+func (m *Manager) CertFile() string {
+	return filepath.Join(m.opts.Dir, CertName)
+}
+
+// KeyFile 服务证书私钥的本地路径
+func (m *Manager) KeyFile() string {
+	return filepath.Join(m.opts.Dir, KeyName)
+}
+
+// CABundle 当前CA证书，PEM格式，CA重新生成后的CAOverlap时间内同时包含旧CA证书
+func (m *Manager) CABundle() []byte {
+	return m.caBundle
+}
+
+// Ensure 确保Secret中的CA和服务证书有效，写入本地目录并更新Webhook配置的caBundle
+func (m *Manager) Ensure() error {
+	var data map[string][]byte
+	// 多副本同时启动时只有一个可以创建或更新成功，其他副本重新读取Secret
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}, func() (err error) {
+		data, err = m.ensureSecret()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.writeFiles(data); err != nil {
+		return err
+	}
+	m.caBundle = caBundle(data)
+	return m.patchCABundle()
+}
+
+// Run 周期性检查证书是否需要更新，直到stopCh关闭
+func (m *Manager) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(RenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := m.Ensure(); err != nil {
+				log.Errorf("Ensure self-signed certificate error: %v", err)
+			}
+		}
+	}
+}
+
+// 读取Secret，CA或服务证书无效、即将过期时重新生成并保存
+func (m *Manager) ensureSecret() (map[string][]byte, error) {
+	secrets := m.client.CoreV1().Secrets(m.opts.Namespace)
+	secret, err := secrets.Get(context.TODO(), m.opts.SecretName, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	exists := err == nil
+	if !exists {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.opts.SecretName,
+				Namespace: m.opts.Namespace,
+				Labels:    map[string]string{ManagedByLabel: ManagedBy},
+			},
+			Type: corev1.SecretTypeTLS,
+		}
+	} else if !managedSecret(secret) {
+		return nil, fmt.Errorf("secret %s/%s was not created by king-preset, refuse to overwrite it, use another --cert-secret", m.opts.Namespace, m.opts.SecretName)
+	}
+	data, changed, err := m.renew(secret.Data, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return data, nil
+	}
+	secret.Data = data
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	secret.Labels[ManagedByLabel] = ManagedBy
+	if exists {
+		_, err = secrets.Update(context.TODO(), secret, metav1.UpdateOptions{})
+	} else {
+		_, err = secrets.Create(context.TODO(), secret, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Save self-signed certificate to secret %s/%s", m.opts.Namespace, m.opts.SecretName)
+	return data, nil
+}
+
+// Secret是否由king-preset创建，旧版本创建的Secret没有标签，但是保存了CA私钥
+func managedSecret(secret *corev1.Secret) bool {
+	return secret.Labels[ManagedByLabel] == ManagedBy || len(secret.Data[CAKeyName]) != 0
+}
+
+// 根据现有的证书数据判断是否需要重新生成，返回最终的证书数据以及是否发生了变化
+func (m *Manager) renew(old map[string][]byte, now time.Time) (map[string][]byte, bool, error) {
+	data := map[string][]byte{}
+	for k, v := range old {
+		data[k] = v
+	}
+	changed := false
+	if err := VerifyCA(data[CACertName], data[CAKeyName], now, CARenewBefore); err != nil {
+		log.Infof("Generate self-signed CA: %v", err)
+		caCert, caKey, err := GenerateCA(now)
+		if err != nil {
+			return nil, false, err
+		}
+		// 保留旧CA，其他副本更新服务证书前API Server仍然可以校验旧CA签发的证书
+		delete(data, PreviousCACertName)
+		delete(data, CARotatedAtName)
+		if len(data[CACertName]) != 0 {
+			data[PreviousCACertName] = data[CACertName]
+			data[CARotatedAtName] = []byte(now.UTC().Format(time.RFC3339))
+		}
+		data[CACertName], data[CAKeyName] = caCert, caKey
+		changed = true
+	} else if _, ok := data[PreviousCACertName]; ok {
+		// 超过CAOverlap后所有副本都已经使用新CA签发的服务证书，删除旧CA
+		rotatedAt, err := time.Parse(time.RFC3339, string(data[CARotatedAtName]))
+		if err != nil || now.Sub(rotatedAt) >= CAOverlap {
+			log.Infof("Remove previous self-signed CA from caBundle")
+			delete(data, PreviousCACertName)
+			delete(data, CARotatedAtName)
+			changed = true
+		}
+	}
+	if err := VerifyServingCert(data[CACertName], data[CertName], data[KeyName], m.opts.DNSNames(), now, RenewBefore); err != nil {
+		log.Infof("Generate serving certificate for %s: %v", m.opts.DNSNames()[0], err)
+		cert, key, err := GenerateServingCert(data[CACertName], data[CAKeyName], m.opts.DNSNames(), now)
+		if err != nil {
+			return nil, false, err
+		}
+		data[CertName], data[KeyName] = cert, key
+		changed = true
+	}
+	return data, changed, nil
+}
+
+// Webhook配置使用的caBundle，新CA在前，旧CA在后
+func caBundle(data map[string][]byte) []byte {
+	bundle := append([]byte{}, data[CACertName]...)
+	if previous := data[PreviousCACertName]; len(previous) != 0 {
+		if len(bundle) != 0 && bundle[len(bundle)-1] != '\n' {
+			bundle = append(bundle, '\n')
+		}
+		bundle = append(bundle, previous...)
+	}
+	return bundle
+}
+
+// 将服务证书写入本地目录，内容未变化时不写入，先写临时文件再重命名避免读取到写了一半的文件
+func (m *Manager) writeFiles(data map[string][]byte) error {
+	if err := os.MkdirAll(m.opts.Dir, 0700); err != nil {
+		return err
+	}
+	files := map[string][]byte{
+		m.CertFile(): data[CertName],
+		m.KeyFile():  data[KeyName],
+	}
+	for name, content := range files {
+		if old, err := ioutil.ReadFile(name); err == nil && bytes.Equal(old, content) {
+			continue
+		}
+		tmp := name + ".tmp"
+		if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 更新Mutating/ValidatingWebhookConfiguration中所有webhook的caBundle，配置不存在时跳过
+func (m *Manager) patchCABundle() error {
+	name := m.opts.WebhookConfigName
+	mutating := m.client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		config, err := mutating.Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		changed := false
+		for i := range config.Webhooks {
+			if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, m.caBundle) {
+				config.Webhooks[i].ClientConfig.CABundle = m.caBundle
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		_, err = mutating.Update(context.TODO(), config, metav1.UpdateOptions{})
+		if err == nil {
+			log.Infof("Update caBundle of MutatingWebhookConfiguration %s", name)
+		}
+		return err
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	validating := m.client.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		config, err := validating.Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		changed := false
+		for i := range config.Webhooks {
+			if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, m.caBundle) {
+				config.Webhooks[i].ClientConfig.CABundle = m.caBundle
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		_, err = validating.Update(context.TODO(), config, metav1.UpdateOptions{})
+		if err == nil {
+			log.Infof("Update caBundle of ValidatingWebhookConfiguration %s", name)
+		}
+		return err
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestManagerEnsure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "king-preset-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := Options{
+		Service:           "king-preset",
+		Namespace:         "kingfisher-system",
+		SecretName:        "king-preset-ca",
+		WebhookConfigName: "king-preset",
+		Dir:               dir,
+	}
+	client := fake.NewSimpleClientset(
+		&admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: opts.WebhookConfigName},
+			Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "fix.pod.ip"}},
+		},
+	)
+	m := NewManager(client, opts)
+	if err := m.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := client.CoreV1().Secrets(opts.Namespace).Get(context.TODO(), opts.SecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("secret not created: %v", err)
+	}
+	if secret.Labels[ManagedByLabel] != ManagedBy {
+		t.Errorf("secret labels %v, want %s=%s", secret.Labels, ManagedByLabel, ManagedBy)
+	}
+	if err := VerifyServingCert(secret.Data[CACertName], secret.Data[CertName], secret.Data[KeyName], opts.DNSNames(), time.Now(), RenewBefore); err != nil {
+		t.Errorf("serving certificate invalid: %v", err)
+	}
+	if _, err := LoadKeyPair(m.CertFile(), m.KeyFile()); err != nil {
+		t.Errorf("serving certificate not written: %v", err)
+	}
+	mutating, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), opts.WebhookConfigName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mutating.Webhooks[0].ClientConfig.CABundle, secret.Data[CACertName]) {
+		t.Error("caBundle was not patched")
+	}
+
+	// 证书有效时不重新生成
+	data, changed, err := m.renew(secret.Data, time.Now())
+	if err != nil || changed {
+		t.Errorf("valid certificates: changed=%v err=%v, want unchanged", changed, err)
+	}
+	// 服务证书即将过期时只重新签发服务证书，CA保持不变
+	data, changed, err = m.renew(secret.Data, time.Now().Add(ServingValidity-RenewBefore/2))
+	if err != nil || !changed {
+		t.Fatalf("expiring serving certificate: changed=%v err=%v, want renewed", changed, err)
+	}
+	if !bytes.Equal(data[CACertName], secret.Data[CACertName]) || bytes.Equal(data[CertName], secret.Data[CertName]) {
+		t.Error("only the serving certificate should be renewed")
+	}
+
+	// CA即将过期时重新生成CA，旧CA在CAOverlap时间内保留在caBundle中
+	rotatedAt := time.Now().Add(CAValidity - CARenewBefore/2)
+	data, changed, err = m.renew(secret.Data, rotatedAt)
+	if err != nil || !changed {
+		t.Fatalf("expiring CA: changed=%v err=%v, want renewed", changed, err)
+	}
+	if !bytes.Equal(data[PreviousCACertName], secret.Data[CACertName]) || bytes.Equal(data[CACertName], secret.Data[CACertName]) {
+		t.Fatal("previous CA should be kept after rotation")
+	}
+	if bundle := caBundle(data); !bytes.Contains(bundle, data[CACertName]) || !bytes.Contains(bundle, secret.Data[CACertName]) {
+		t.Error("caBundle should contain both the new and the previous CA")
+	}
+	if _, changed, _ := m.renew(data, rotatedAt.Add(RenewInterval)); changed {
+		t.Error("previous CA removed before CAOverlap")
+	}
+	data, changed, err = m.renew(data, rotatedAt.Add(CAOverlap))
+	if err != nil || !changed {
+		t.Fatalf("after CAOverlap: changed=%v err=%v, want previous CA removed", changed, err)
+	}
+	if _, ok := data[PreviousCACertName]; ok || !bytes.Equal(caBundle(data), data[CACertName]) {
+		t.Error("previous CA should be removed from caBundle after CAOverlap")
+	}
+}
+
+func TestManagerRefuseForeignSecret(t *testing.T) {
+	opts := Options{Service: "king-preset", Namespace: "kingfisher-system", SecretName: "king-preset", Dir: os.TempDir()}
+	// deployment.sh创建的TLS Secret，没有managed-by标签和CA私钥
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: opts.SecretName, Namespace: opts.Namespace},
+		Type:       corev1.SecretTypeTLS,
+		Data:       map[string][]byte{CertName: []byte("cert"), KeyName: []byte("key")},
+	})
+	if err := NewManager(client, opts).Ensure(); err == nil {
+		t.Fatal("expected error for secret not created by king-preset")
+	}
+	secret, err := client.CoreV1().Secrets(opts.Namespace).Get(context.TODO(), opts.SecretName, metav1.GetOptions{})
+	if err != nil || string(secret.Data[CertName]) != "cert" {
+		t.Errorf("foreign secret was modified: %+v %v", secret, err)
+	}
+}
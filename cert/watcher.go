@@ -0,0 +1,111 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	metricsNamespace = "king_preset"
+	// 检查证书文件是否变化的周期，secret更新后kubelet同步到Pod内本身也有分钟级延迟
+	ReloadInterval = 10 * time.Second
+)
+
+var (
+	// 证书重新加载次数，result为success或failure
+	reloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_reloads_total",
+		Help:      "Number of serving certificate reloads, by result (success, failure).",
+	}, []string{"result"})
+	// 当前使用证书的过期时间
+	expiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Expiry time of the serving certificate in use, as a unix timestamp.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(reloads, expiry)
+}
+
+// 当前正在使用的Watcher，用于就绪检查
+var watcher *Watcher
+
+// Watcher 定期检查证书和私钥文件，变化后原子替换正在使用的证书，无需重启Pod
+type Watcher struct {
+	certFile string
+	keyFile  string
+	certPEM  []byte
+	keyPEM   []byte
+	current  atomic.Value // *tls.Certificate
+}
+
+// NewWatcher 加载证书和私钥，加载失败时返回错误
+func NewWatcher(certFile, keyFile string) (*Watcher, error) {
+	w := &Watcher{certFile: certFile, keyFile: keyFile}
+	if _, err := w.reload(); err != nil {
+		return nil, err
+	}
+	watcher = w
+	return w, nil
+}
+
+// GetCertificate 用于tls.Config，每次握手都使用最新加载的证书
+func (w *Watcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return w.Current(), nil
+}
+
+// Current 当前使用的证书
+func (w *Watcher) Current() *tls.Certificate {
+	return w.current.Load().(*tls.Certificate)
+}
+
+// Run 周期性检查证书文件，直到stopCh关闭
+func (w *Watcher) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if changed, err := w.reload(); err != nil {
+				reloads.WithLabelValues("failure").Inc()
+				log.Errorf("Reload certificate %s error, keep using the previous one: %v", w.certFile, err)
+			} else if changed {
+				reloads.WithLabelValues("success").Inc()
+				log.Infof("Reload certificate %s, expires at %s", w.certFile, w.Current().Leaf.NotAfter)
+			}
+		}
+	}
+}
+
+// 文件内容变化时重新加载证书，返回是否发生了替换
+func (w *Watcher) reload() (bool, error) {
+	certPEM, err := ioutil.ReadFile(w.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := ioutil.ReadFile(w.keyFile)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(certPEM, w.certPEM) && bytes.Equal(keyPEM, w.keyPEM) {
+		return false, nil
+	}
+	pair, err := parseKeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+	w.certPEM, w.keyPEM = certPEM, keyPEM
+	w.current.Store(pair)
+	expiry.Set(float64(pair.Leaf.NotAfter.Unix()))
+	return true, nil
+}
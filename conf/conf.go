@@ -0,0 +1,148 @@
+package conf
+
+import (
+	"flag"
+	"fmt"
+	"github.com/open-kingfisher/king-preset/cert"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix 环境变量前缀，例如: KING_PRESET_LISTEN_ADDR
+const EnvPrefix = "KING_PRESET_"
+
+// Config king-preset的启动配置
+// 优先级从低到高: 默认值、--config指定的YAML文件、环境变量、命令行参数
+type Config struct {
+	ListenAddr            string `json:"listenAddr"`            // webhook的HTTPS监听地址
+	CertDir               string `json:"certDir"`               // tls.crt 和 tls.key 所在目录
+	SidecarImage          string `json:"sidecarImage"`          // 日志sidecar的镜像
+	SidecarPullPolicy     string `json:"sidecarPullPolicy"`     // 日志sidecar的镜像拉取策略
+	DefaultMetricInterval string `json:"defaultMetricInterval"` // 未设置metric-interval注解时监控脚本的执行周期，单位秒
+	DefaultLogDirectory   string `json:"defaultLogDirectory"`   // 未设置log-file-directory注解时的业务日志目录
+	FailurePolicy         string `json:"failurePolicy"`         // 预设内部错误时的处理策略，例如: fix-pod-ip=fail-open，启动时由impl.SetFailurePolicies校验
+}
+
+// Default 默认配置
+func Default() *Config {
+	return &Config{
+		ListenAddr:            ":443",
+		CertDir:               cert.DefaultDir,
+		SidecarImage:          "registry.wap.sina.cn/kingfisher/king-exporter:latest",
+		SidecarPullPolicy:     string(corev1.PullAlways),
+		DefaultMetricInterval: "60",
+		DefaultLogDirectory:   "/var/log",
+	}
+}
+
+type field struct {
+	flag  string
+	env   string
+	usage string
+	value *string
+}
+
+func (c *Config) fields() []field {
+	return []field{
+		{"listen-addr", "LISTEN_ADDR", "HTTPS listen address of the webhook", &c.ListenAddr},
+		{"cert-dir", "CERT_DIR", "Directory containing tls.crt and tls.key", &c.CertDir},
+		{"sidecar-image", "SIDECAR_IMAGE", "Image of the injected log sidecar", &c.SidecarImage},
+		{"sidecar-pull-policy", "SIDECAR_PULL_POLICY", "Image pull policy of the injected log sidecar, Options: [Always|IfNotPresent|Never]", &c.SidecarPullPolicy},
+		{"default-metric-interval", "DEFAULT_METRIC_INTERVAL", "Default metric script interval in seconds when the metric-interval annotation is not set", &c.DefaultMetricInterval},
+		{"default-log-dir", "DEFAULT_LOG_DIR", "Default business log directory when the log-file-directory annotation is not set", &c.DefaultLogDirectory},
+		{"failure-policy", "FAILURE_POLICY", "Failure policy of presets on internal errors, Options: [fail-open|fail-closed], e.g. fix-pod-ip=fail-open,log-sidecar-inject=fail-closed", &c.FailurePolicy},
+	}
+}
+
+// Flags 配置相关的命令行参数
+type Flags struct {
+	file   *string
+	values *Config
+}
+
+// AddFlags 在FlagSet中注册--config以及各个配置项的命令行参数，需要在Parse之前调用
+func AddFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{
+		file:   fs.String("config", "", "Path of the YAML config file"),
+		values: Default(),
+	}
+	for _, field := range f.values.fields() {
+		fs.StringVar(field.value, field.flag, *field.value, fmt.Sprintf("%s (env %s%s)", field.usage, EnvPrefix, field.env))
+	}
+	return f
+}
+
+// Load 按优先级合并默认值、YAML文件、环境变量和命令行参数，并校验配置
+func (f *Flags) Load(fs *flag.FlagSet) (*Config, error) {
+	c := Default()
+	if *f.file != "" {
+		data, err := ioutil.ReadFile(*f.file)
+		if err != nil {
+			return nil, fmt.Errorf("read config file %s error: %v", *f.file, err)
+		}
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("parse config file %s error: %v", *f.file, err)
+		}
+	}
+	for _, field := range c.fields() {
+		if v, ok := os.LookupEnv(EnvPrefix + field.env); ok {
+			*field.value = v
+		}
+	}
+	// 只有显式设置的命令行参数才覆盖配置文件和环境变量
+	values := make(map[string]*string)
+	for _, field := range f.values.fields() {
+		values[field.flag] = field.value
+	}
+	fields := make(map[string]*string)
+	for _, field := range c.fields() {
+		fields[field.flag] = field.value
+	}
+	fs.Visit(func(fl *flag.Flag) {
+		if v, ok := values[fl.Name]; ok {
+			*fields[fl.Name] = *v
+		}
+	})
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate 校验配置，返回所有不合法的配置项
+func (c *Config) Validate() error {
+	var errs []error
+	if _, port, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("listenAddr '%s' is invalid: %v", c.ListenAddr, err))
+	} else if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		errs = append(errs, fmt.Errorf("listenAddr '%s' has an invalid port", c.ListenAddr))
+	}
+	if c.CertDir == "" {
+		errs = append(errs, fmt.Errorf("certDir is empty"))
+	}
+	if c.SidecarImage == "" || strings.ContainsAny(c.SidecarImage, " \t\n") {
+		errs = append(errs, fmt.Errorf("sidecarImage '%s' is invalid", c.SidecarImage))
+	}
+	switch corev1.PullPolicy(c.SidecarPullPolicy) {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		errs = append(errs, fmt.Errorf("sidecarPullPolicy '%s' is invalid, expected Always, IfNotPresent or Never", c.SidecarPullPolicy))
+	}
+	if interval, err := strconv.Atoi(c.DefaultMetricInterval); err != nil || interval <= 0 {
+		errs = append(errs, fmt.Errorf("defaultMetricInterval '%s' is not a positive integer", c.DefaultMetricInterval))
+	}
+	if !filepath.IsAbs(c.DefaultLogDirectory) {
+		errs = append(errs, fmt.Errorf("defaultLogDirectory '%s' is not an absolute path", c.DefaultLogDirectory))
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("invalid config: %v", utilerrors.NewAggregate(errs))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package conf
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "king-preset-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	data := "listenAddr: \":8443\"\nsidecarImage: file/image:v1\ndefaultLogDirectory: /data/log\nfailurePolicy: fix-pod-ip=fail-closed\n"
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(EnvPrefix+"SIDECAR_IMAGE", "env/image:v1")
+	os.Setenv(EnvPrefix+"DEFAULT_LOG_DIR", "/env/log")
+	defer os.Unsetenv(EnvPrefix + "SIDECAR_IMAGE")
+	defer os.Unsetenv(EnvPrefix + "DEFAULT_LOG_DIR")
+	os.Setenv(EnvPrefix+"FAILURE_POLICY", "fix-pod-ip=fail-open")
+	defer os.Unsetenv(EnvPrefix + "FAILURE_POLICY")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := AddFlags(fs)
+	if err := fs.Parse([]string{"--config", file, "--default-log-dir", "/flag/log"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := f.Load(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ListenAddr != ":8443" {
+		t.Errorf("listenAddr from file expected ':8443', got '%s'", c.ListenAddr)
+	}
+	if c.SidecarImage != "env/image:v1" {
+		t.Errorf("sidecarImage from env expected 'env/image:v1', got '%s'", c.SidecarImage)
+	}
+	if c.DefaultLogDirectory != "/flag/log" {
+		t.Errorf("defaultLogDirectory from flag expected '/flag/log', got '%s'", c.DefaultLogDirectory)
+	}
+	if c.FailurePolicy != "fix-pod-ip=fail-open" {
+		t.Errorf("failurePolicy from env expected 'fix-pod-ip=fail-open', got '%s'", c.FailurePolicy)
+	}
+	if c.DefaultMetricInterval != Default().DefaultMetricInterval {
+		t.Errorf("defaultMetricInterval expected default, got '%s'", c.DefaultMetricInterval)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("default config is invalid: %v", err)
+	}
+	c := Default()
+	c.ListenAddr = "443"
+	c.SidecarPullPolicy = "Sometimes"
+	c.DefaultMetricInterval = "0"
+	c.DefaultLogDirectory = "var/log"
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("invalid config passed validation")
+	}
+	for _, name := range []string{"listenAddr", "sidecarPullPolicy", "defaultMetricInterval", "defaultLogDirectory"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error does not mention %s: %v", name, err)
+		}
+	}
+}
+
+func TestLoadUnknownField(t *testing.T) {
+	dir, err := ioutil.TempDir("", "king-preset-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("image: image:v1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := AddFlags(fs)
+	if err := fs.Parse([]string{"--config", file}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Load(fs); err == nil {
+		t.Error("unknown field in config file passed")
+	}
+}
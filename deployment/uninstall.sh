@@ -1,4 +1,5 @@
 #!/usr/bin/env bash
 
 kubectl delete -f deployment_all_in_one.yaml
-kubectl delete secret king-preset -n kingfisher
\ No newline at end of file
+kubectl delete -f crd_fixed_ip_pool.yaml
+kubectl delete secret king-preset -n kingfisher-systemkubectl delete secret king-preset-ca -n kingfisher-system --ignore-not-found
@@ -8,7 +8,7 @@ chmod 0700 "$key_dir"
 cd "$key_dir"
 
 [ -z "$service" ] && service=king-preset
-[ -z "$namespace" ] && namespace=kingfisher
+[ -z "$namespace" ] && namespace=kingfisher-system
 
 # 生成CA证书和CA私钥
 openssl req -nodes -new -x509 -keyout ca.key -out ca.crt -subj "/CN=Admission Controller Webhook Kingfisher"  -days 36500
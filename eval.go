@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/open-kingfisher/king-preset/conf"
+	"github.com/open-kingfisher/king-preset/impl"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"io"
+	"io/ioutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"os"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// eval子命令的退出码
+const (
+	evalAllowed = 0
+	evalDenied  = 1
+	evalError   = 2
+)
+
+// 离线评估预设对本地资源清单的处理结果，不连接任何集群
+// 资源清单包装为AdmissionReview后交给预设处理，输出结果、JSONPatch以及修改后的资源
+func runEval(args []string) int {
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+	file := fs.String("f", "", "Manifest file to evaluate, - for stdin, multiple documents separated by ---")
+	presetName := fs.String("preset", "", "Only evaluate this preset, defaults to all presets handling the kind")
+	action := fs.String("action", "", "Only run this action, Options: [mutate|validate], defaults to both")
+	operation := fs.String("operation", string(admissionv1.Create), "Admission operation, Options: [CREATE|UPDATE|DELETE]")
+	presetConfigFile := fs.String("preset-config", "", "Preset config file, same format as config.yaml in the preset config ConfigMap")
+	verbose := fs.Bool("v", false, "Print the logs of presets")
+	configFlags := conf.AddFlags(fs)
+	fs.Parse(args)
+
+	if !*verbose {
+		log.SetLoggerLevel("fatal")
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "eval: -f is required")
+		fs.Usage()
+		return evalError
+	}
+	if *action != "" && *action != impl.MutateAction && *action != impl.ValidateAction {
+		fmt.Fprintf(os.Stderr, "eval: --action must be '%s' or '%s'\n", impl.MutateAction, impl.ValidateAction)
+		return evalError
+	}
+	op := admissionv1.Operation(strings.ToUpper(*operation))
+	if op != admissionv1.Create && op != admissionv1.Update && op != admissionv1.Delete {
+		fmt.Fprintf(os.Stderr, "eval: unsupported --operation '%s'\n", *operation)
+		return evalError
+	}
+	cfg, err := configFlags.Load(fs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+		return evalError
+	}
+	setLogSidecarConfig(cfg)
+	if *presetConfigFile != "" {
+		data, err := ioutil.ReadFile(*presetConfigFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+			return evalError
+		}
+		presetConfig, err := impl.ParsePresetConfig(string(data))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "eval: preset config %s: %v\n", *presetConfigFile, err)
+			return evalError
+		}
+		impl.SetPresetConfig(presetConfig)
+	}
+	// 需要访问集群的预设使用内存中的fake clientSet
+	impl.SetClientOptions(impl.ClientOptions{DryRun: true})
+
+	objects, err := readManifests(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+		return evalError
+	}
+	code := evalAllowed
+	for i, obj := range objects {
+		for _, preset := range impl.Presets() {
+			if *presetName != "" && preset.Name() != *presetName {
+				continue
+			}
+			for _, a := range []string{impl.MutateAction, impl.ValidateAction} {
+				if *action != "" && a != *action {
+					continue
+				}
+				kinds := preset.MutateKinds()
+				if a == impl.ValidateAction {
+					kinds = preset.ValidateKinds()
+				}
+				if !contains(kinds, obj.GetKind()) {
+					continue
+				}
+				req, err := evalRequest(i, obj, op)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+					return evalError
+				}
+				response := impl.Review(preset, a, req)
+				if !response.Allowed {
+					code = evalDenied
+				}
+				if err := printReview(os.Stdout, preset, a, req, response); err != nil {
+					fmt.Fprintf(os.Stderr, "eval: %v\n", err)
+					return evalError
+				}
+			}
+		}
+	}
+	return code
+}
+
+// 读取资源清单，支持YAML和JSON，多个资源使用---分隔
+func readManifests(file string) ([]*unstructured.Unstructured, error) {
+	var reader io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		reader = f
+	}
+	var objects []*unstructured.Unstructured
+	decoder := utilyaml.NewYAMLOrJSONDecoder(reader, 4096)
+	for {
+		obj := map[string]interface{}{}
+		if err := decoder.Decode(&obj); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("decode %s error: %v", file, err)
+		}
+		if len(obj) == 0 {
+			continue
+		}
+		u := &unstructured.Unstructured{Object: obj}
+		if u.GetKind() == "" {
+			return nil, fmt.Errorf("%s: document %d has no kind", file, len(objects))
+		}
+		objects = append(objects, u)
+	}
+	return objects, nil
+}
+
+// 将资源包装为AdmissionRequest，dryRun为true，预设不会创建或删除其他资源
+func evalRequest(index int, obj *unstructured.Unstructured, op admissionv1.Operation) (*admissionv1.AdmissionRequest, error) {
+	raw, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	namespace := obj.GetNamespace()
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	gvk := schema.FromAPIVersionAndKind(obj.GetAPIVersion(), obj.GetKind())
+	dryRun := true
+	req := &admissionv1.AdmissionRequest{
+		UID:       types.UID(fmt.Sprintf("eval-%d", index)),
+		Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Name:      obj.GetName(),
+		Namespace: namespace,
+		Operation: op,
+		DryRun:    &dryRun,
+	}
+	switch op {
+	case admissionv1.Create:
+		req.Object = runtime.RawExtension{Raw: raw}
+	case admissionv1.Update:
+		req.Object = runtime.RawExtension{Raw: raw}
+		req.OldObject = runtime.RawExtension{Raw: raw}
+	case admissionv1.Delete:
+		req.OldObject = runtime.RawExtension{Raw: raw}
+	}
+	return req, nil
+}
+
+// 输出预设的处理结果、JSONPatch以及修改后的资源
+func printReview(w io.Writer, preset impl.Preset, action string, req *admissionv1.AdmissionRequest, response *admissionv1.AdmissionResponse) error {
+	name := req.Name
+	if name == "" {
+		name = "<generated>"
+	}
+	fmt.Fprintf(w, "# %s %s: %s %s/%s\n", preset.Name(), action, req.Kind.Kind, req.Namespace, name)
+	if response.Allowed {
+		fmt.Fprintln(w, "verdict: allowed")
+	} else {
+		fmt.Fprintln(w, "verdict: denied")
+	}
+	if response.Result != nil {
+		fmt.Fprintf(w, "code: %d\nmessage: %s\n", response.Result.Code, response.Result.Message)
+	}
+	for _, warning := range response.Warnings {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+	if len(response.Patch) == 0 {
+		fmt.Fprintln(w, "---")
+		return nil
+	}
+	var patch bytes.Buffer
+	if err := json.Indent(&patch, response.Patch, "", "  "); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "patch: |\n%s\n", indent(patch.String(), "  "))
+	decoded, err := jsonpatch.DecodePatch(response.Patch)
+	if err != nil {
+		return fmt.Errorf("decode patch error: %v", err)
+	}
+	patched, err := decoded.Apply(req.Object.Raw)
+	if err != nil {
+		fmt.Fprintf(w, "patchError: %v\n---\n", err)
+		return nil
+	}
+	patchedYAML, err := yaml.JSONToYAML(patched)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "---\n%s---\n", patchedYAML)
+	return nil
+}
+
+func indent(s, prefix string) string {
+	return prefix + strings.Replace(s, "\n", "\n"+prefix, -1)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
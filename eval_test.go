@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const evalPod = `apiVersion: v1
+kind: Pod
+metadata:
+  name: web-1
+  generateName: web-
+  namespace: app
+  annotations:
+    fix.pod.ip: '[{"node01":["10.10.10.101"]},{"node02":["10.10.10.102"]}]'
+spec:
+  containers:
+  - name: web
+    image: nginx
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: db-0
+  generateName: db-
+  namespace: app
+spec:
+  containers:
+  - name: db
+    image: mysql
+`
+
+func TestRunEval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "king-preset-eval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "pod.yaml")
+	if err := ioutil.WriteFile(file, []byte(evalPod), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := readManifests(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("expected 2 manifests, got %d", len(objects))
+	}
+	// db-0没有fix.pod.ip注解，会被拒绝
+	if code := runEval([]string{"-f", file, "--preset", "fix-pod-ip"}); code != evalDenied {
+		t.Errorf("expected exit code %d, got %d", evalDenied, code)
+	}
+	if code := runEval([]string{"-f", file, "--preset", "fix-pod-ip", "--action", "validate"}); code != evalAllowed {
+		t.Errorf("expected exit code %d, got %d", evalAllowed, code)
+	}
+	if code := runEval([]string{"-f", filepath.Join(dir, "missing.yaml")}); code != evalError {
+		t.Errorf("expected exit code %d, got %d", evalError, code)
+	}
+}
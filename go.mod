@@ -3,8 +3,16 @@ module github.com/open-kingfisher/king-preset
 go 1.14
 
 require (
+	github.com/evanphx/json-patch v4.9.0+incompatible
 	github.com/gin-gonic/gin v1.6.2
 	github.com/open-kingfisher/king-utils v0.0.0-20200422073733-6505a8c88560
-	k8s.io/api v0.18.2
-	k8s.io/apimachinery v0.18.2
+	github.com/prometheus/client_golang v1.7.1
+	gomodules.xyz/jsonpatch/v2 v2.1.0
+	k8s.io/api v0.19.2
+	k8s.io/apimachinery v0.19.2
+	k8s.io/client-go v11.0.0+incompatible
+	sigs.k8s.io/yaml v1.2.0
 )
+
+// king-utils 依赖 k8s.io/client-go v11.0.0+incompatible，这里固定为与 k8s.io/api 相同的版本
+replace k8s.io/client-go => k8s.io/client-go v0.19.2
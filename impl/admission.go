@@ -0,0 +1,69 @@
+package impl
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+)
+
+const (
+	AdmissionReviewKind     = "AdmissionReview"
+	AdmissionV1             = "admission.k8s.io/v1"
+	AdmissionV1beta1        = "admission.k8s.io/v1beta1"
+	DefaultAdmissionVersion = AdmissionV1beta1 // 未携带apiVersion的请求按v1beta1处理，兼容老版本API Server
+)
+
+// 解析AdmissionReview，同时支持admission.k8s.io/v1和admission.k8s.io/v1beta1
+// 两个版本的AdmissionReview字段完全一致，所以统一使用v1的结构体进行解析
+// 解析失败时也会返回已解析出的部分，用于拒绝时携带apiVersion和UID
+func decodeAdmissionReview(c *gin.Context) (*admissionv1.AdmissionReview, error) {
+	ar := &admissionv1.AdmissionReview{}
+	if err := c.ShouldBindBodyWith(ar, binding.JSON); err != nil {
+		return ar, err
+	}
+	switch ar.APIVersion {
+	case "":
+		ar.APIVersion = DefaultAdmissionVersion
+	case AdmissionV1, AdmissionV1beta1:
+	default:
+		return ar, fmt.Errorf("unsupported AdmissionReview apiVersion '%s', expected '%s' or '%s'", ar.APIVersion, AdmissionV1, AdmissionV1beta1)
+	}
+	if ar.Request == nil {
+		return ar, fmt.Errorf("AdmissionReview request is empty")
+	}
+	return ar, nil
+}
+
+// 按照请求的apiVersion返回AdmissionReview，v1版本要求Response中必须带有apiVersion和kind
+func writeAdmissionReview(c *gin.Context, ar *admissionv1.AdmissionReview, admissionResponse *admissionv1.AdmissionResponse) {
+	admissionReview := admissionv1.AdmissionReview{}
+	admissionReview.APIVersion = ar.APIVersion
+	admissionReview.Kind = AdmissionReviewKind
+	if admissionResponse != nil {
+		admissionReview.Response = admissionResponse
+		if ar.Request != nil {
+			admissionReview.Response.UID = ar.Request.UID
+		}
+	}
+	c.JSON(http.StatusOK, admissionReview)
+}
+
+// 请求体无法解析时同样返回格式正确的AdmissionReview并拒绝此次请求
+// 直接返回500会被API Server当作webhook调用失败，failurePolicy为Ignore时还会被静默放行
+func writeMalformedReview(c *gin.Context, ar *admissionv1.AdmissionReview, err error) {
+	if ar.APIVersion != AdmissionV1 && ar.APIVersion != AdmissionV1beta1 {
+		ar.APIVersion = DefaultAdmissionVersion
+	}
+	writeAdmissionReview(c, ar, &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusBadRequest,
+			Reason:  metav1.StatusReasonBadRequest,
+			Message: fmt.Sprintf("malformed AdmissionReview: %v", err),
+		},
+	})
+}
@@ -0,0 +1,46 @@
+package impl
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMalformedAdmissionReview(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	preset := fixPodIP{}
+	r := gin.New()
+	r.POST("/mutate", MutateHandler(preset))
+
+	bodies := map[string]string{
+		"invalid json":        `{"apiVersion":`,
+		"unsupported version": `{"apiVersion":"admission.k8s.io/v2","request":{"uid":"uid-1"}}`,
+		"empty request":       `{"apiVersion":"admission.k8s.io/v1"}`,
+	}
+	for name, body := range bodies {
+		before := testutil.ToFloat64(malformedRequests.WithLabelValues(preset.Name(), MutateAction))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: http code %d, want %d", name, w.Code, http.StatusOK)
+		}
+		review := admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+			t.Fatalf("%s: response is not an AdmissionReview: %v", name, err)
+		}
+		if review.Kind != AdmissionReviewKind || review.Response == nil {
+			t.Fatalf("%s: response %s is not an AdmissionReview", name, w.Body.String())
+		}
+		if review.Response.Allowed || review.Response.Result == nil || review.Response.Result.Code != http.StatusBadRequest {
+			t.Errorf("%s: response %s, want denied with code 400", name, w.Body.String())
+		}
+		if after := testutil.ToFloat64(malformedRequests.WithLabelValues(preset.Name(), MutateAction)); after != before+1 {
+			t.Errorf("%s: malformed requests counter %v, want %v", name, after, before+1)
+		}
+	}
+}
@@ -1,18 +1,197 @@
 package impl
 
 import (
+	"context"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func K8SClient() (*kubernetes.Clientset, error) {
-	cfg, err := clientcmd.BuildConfigFromFlags("", "") //使用InClusterConfig
+const (
+	APIServerCheckTimeout = 5 * time.Second
+	InformerResync        = 10 * time.Minute
+)
+
+// ClientOptions 连接API Server的方式
+type ClientOptions struct {
+	Kubeconfig string // kubeconfig文件路径，为空时使用KUBECONFIG环境变量
+	Context    string // kubeconfig中的context，为空时使用current-context
+	DryRun     bool   // 使用fake clientSet，不连接任何集群，用于本地调试
+}
+
+var (
+	clientOptions ClientOptions
+	clientOnce    sync.Once
+	clientSet     kubernetes.Interface
+	clientErr     error
+
+	dynamicOnce      sync.Once
+	dynamicClientSet dynamic.Interface
+	dynamicErr       error
+)
+
+// SetClientOptions 设置连接API Server的方式，需要在第一次调用K8SClient之前设置
+func SetClientOptions(opts ClientOptions) {
+	clientOptions = opts
+}
+
+// K8SClient 返回共享的clientSet，只在第一次调用时创建
+func K8SClient() (kubernetes.Interface, error) {
+	clientOnce.Do(func() {
+		if clientSet != nil {
+			return
+		}
+		if clientOptions.DryRun {
+			log.Warnf("Dry-run client enabled, all resources are stored in memory")
+			clientSet = fake.NewSimpleClientset()
+			return
+		}
+		cfg, err := restConfig(clientOptions)
+		if err != nil {
+			clientErr = err
+			return
+		}
+		clientSet, clientErr = kubernetes.NewForConfig(cfg)
+	})
+	return clientSet, clientErr
+}
+
+// DynamicClient 返回共享的dynamic client，用于访问FixedIPPool等自定义资源
+func DynamicClient() (dynamic.Interface, error) {
+	dynamicOnce.Do(func() {
+		if dynamicClientSet != nil {
+			return
+		}
+		if clientOptions.DryRun {
+			dynamicClientSet = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+			return
+		}
+		cfg, err := restConfig(clientOptions)
+		if err != nil {
+			dynamicErr = err
+			return
+		}
+		dynamicClientSet, dynamicErr = dynamic.NewForConfig(cfg)
+	})
+	return dynamicClientSet, dynamicErr
+}
+
+// 未指定kubeconfig时优先使用InClusterConfig，否则按照--kubeconfig、KUBECONFIG、~/.kube/config的顺序加载
+func restConfig(opts ClientOptions) (*rest.Config, error) {
+	if opts.Kubeconfig == "" && opts.Context == "" && os.Getenv(clientcmd.RecommendedConfigPathEnvVar) == "" {
+		if cfg, err := rest.InClusterConfig(); err == nil {
+			return cfg, nil
+		}
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = opts.Kubeconfig
+	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: opts.Context}).ClientConfig()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("load kubeconfig error: %v", err)
 	}
-	client, err := kubernetes.NewForConfig(cfg)
+	return cfg, nil
+}
+
+// SetK8SClient 替换共享的clientSet，需要在第一次调用K8SClient之前设置
+func SetK8SClient(client kubernetes.Interface) {
+	clientSet, clientErr = client, nil
+}
+
+// SetDynamicClient 替换共享的dynamic client，需要在第一次调用DynamicClient之前设置
+func SetDynamicClient(client dynamic.Interface) {
+	dynamicClientSet, dynamicErr = client, nil
+}
+
+// StartInformers 启动预设使用的informer并等待缓存同步
+// 未启动时资源的查询直接访问API Server
+func StartInformers(stopCh <-chan struct{}) error {
+	client, err := K8SClient()
+	if err != nil {
+		return err
+	}
+	// 只缓存king-preset创建的ConfigMap
+	factory := informers.NewSharedInformerFactoryWithOptions(client, InformerResync, informers.WithTweakListOptions(managedByKingPreset))
+	lister := factory.Core().V1().ConfigMaps().Lister()
+	factory.Start(stopCh)
+	for informerType, synced := range factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return fmt.Errorf("informer %v cache not synced", informerType)
+		}
+	}
+	configMapLister = lister
+	return nil
+}
+
+// 启动自定义资源的informer并等待缓存同步，未安装CRD的资源不启动，不在返回的lister中
+func startDynamicInformers(stopCh <-chan struct{}, resources ...schema.GroupVersionResource) (map[schema.GroupVersionResource]cache.GenericLister, error) {
+	client, err := DynamicClient()
 	if err != nil {
 		return nil, err
 	}
-	return client, nil
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, InformerResync)
+	listers := make(map[schema.GroupVersionResource]cache.GenericLister, len(resources))
+	for _, resource := range resources {
+		if _, err := client.Resource(resource).List(context.TODO(), metav1.ListOptions{Limit: 1}); errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		listers[resource] = factory.ForResource(resource).Lister()
+	}
+	factory.Start(stopCh)
+	for resource, synced := range factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return nil, fmt.Errorf("informer %v cache not synced", resource)
+		}
+	}
+	return listers, nil
+}
+
+// 所有informer缓存同步后为1，之前就绪检查失败，API Server不会把准入请求发送到此Pod
+var informersSynced int32
+
+// SetInformersSynced 所有informer缓存同步后调用
+func SetInformersSynced() {
+	atomic.StoreInt32(&informersSynced, 1)
+}
+
+// CheckInformersSynced 检查informer缓存是否已经同步
+func CheckInformersSynced() error {
+	if atomic.LoadInt32(&informersSynced) == 0 {
+		return fmt.Errorf("informer caches not synced")
+	}
+	return nil
+}
+
+// CheckAPIServer 检查是否可以访问API Server
+func CheckAPIServer() error {
+	clientSet, err := K8SClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), APIServerCheckTimeout)
+	defer cancel()
+	restClient := clientSet.Discovery().RESTClient()
+	if restClient == nil {
+		// fake clientSet没有RESTClient
+		_, err := clientSet.Discovery().ServerVersion()
+		return err
+	}
+	return restClient.Get().AbsPath("/version").Do(ctx).Error()
 }
@@ -0,0 +1,73 @@
+package impl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: kind
+  cluster:
+    server: https://127.0.0.1:6443
+- name: tunnel
+  cluster:
+    server: https://127.0.0.1:16443
+contexts:
+- name: kind
+  context:
+    cluster: kind
+    user: admin
+- name: tunnel
+  context:
+    cluster: tunnel
+    user: admin
+current-context: kind
+users:
+- name: admin
+  user:
+    token: test
+`
+
+func TestRestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "king-preset-kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(file, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := restConfig(ClientOptions{Kubeconfig: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "https://127.0.0.1:6443" {
+		t.Errorf("current-context: got host %s", cfg.Host)
+	}
+	cfg, err = restConfig(ClientOptions{Kubeconfig: file, Context: "tunnel"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "https://127.0.0.1:16443" {
+		t.Errorf("--context tunnel: got host %s", cfg.Host)
+	}
+
+	os.Setenv("KUBECONFIG", file)
+	defer os.Unsetenv("KUBECONFIG")
+	cfg, err = restConfig(ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "https://127.0.0.1:6443" {
+		t.Errorf("KUBECONFIG: got host %s", cfg.Host)
+	}
+	if _, err := restConfig(ClientOptions{Kubeconfig: file, Context: "missing"}); err == nil {
+		t.Error("missing context expected error")
+	}
+}
@@ -0,0 +1,415 @@
+package impl
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common/log"
+	corev1 "k8s.io/api/core/v1"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 为Pod指定固定IP的CNI插件，通过预设配置fixPodIP.cni选择
+const (
+	CNICalico  = "calico"
+	CNIMultus  = "multus"
+	CNICilium  = "cilium"
+	CNIKubeOVN = "kube-ovn"
+
+	CalicoHwAddr      = "cni.projectcalico.org/hwAddr"
+	MultusNetworks    = "k8s.v1.cni.cncf.io/networks"
+	KubeOVNIPAddress  = "ovn.kubernetes.io/ip_address"
+	KubeOVNMACAddress = "ovn.kubernetes.io/mac_address"
+	KubeOVNRoutes     = "ovn.kubernetes.io/routes"
+)
+
+// CNIBackend 通过Pod注解为Pod指定固定IP的CNI插件
+// fix.pod.ip注解的格式与CNI插件无关，由CNIBackend转换为各个CNI插件使用的注解
+type CNIBackend interface {
+	// CNI插件名称，例如: calico
+	Name() string
+	// 为Pod指定IP，IP已经转换为标准格式并且IPv4在前，最多一个IPv4地址和一个IPv6地址
+	SetPodIPs(pod *corev1.Pod, ips []string) error
+	// Pod注解中指定的IP，用于检查IP冲突
+	PodIPs(pod *corev1.Pod) []string
+	// 为Pod指定MAC地址，MAC地址已经转换为标准格式，不支持时返回错误
+	SetPodMAC(pod *corev1.Pod, mac string) error
+	// 为Pod添加路由，不支持时返回错误
+	SetPodRoutes(pod *corev1.Pod, routes []fixedIPRoute) error
+	// Pod注解中指定的MAC地址，用于检查MAC地址冲突
+	PodMAC(pod *corev1.Pod) string
+}
+
+// 为Pod指定fix.pod.ip注解中的MAC地址和路由
+func setPodMACAndRoutes(backend CNIBackend, pod *corev1.Pod, entry fixedIPEntry) error {
+	if entry.MAC != "" {
+		mac, err := canonicalMAC(entry.MAC)
+		if err != nil {
+			return err
+		}
+		if err := backend.SetPodMAC(pod, mac); err != nil {
+			return err
+		}
+	}
+	if len(entry.Routes) != 0 {
+		return backend.SetPodRoutes(pod, entry.Routes)
+	}
+	return nil
+}
+
+// CNI插件不支持此功能
+func unsupported(backend CNIBackend, feature string) error {
+	return fmt.Errorf("cni %s does not support %s", backend.Name(), feature)
+}
+
+// 根据预设配置创建CNI插件，为空时使用calico
+func newCNIBackend(config FixPodIPOverride) (CNIBackend, error) {
+	switch config.CNI {
+	case "", CNICalico:
+		return calicoBackend{}, nil
+	case CNIMultus:
+		if config.Multus.Network == "" {
+			return nil, fmt.Errorf("fixPodIP.multus.network is required when cni is %s", CNIMultus)
+		}
+		for _, prefix := range []struct {
+			length, bits int
+		}{{config.Multus.IPv4PrefixLength, 32}, {config.Multus.IPv6PrefixLength, 128}} {
+			if prefix.length < 0 || prefix.length > prefix.bits {
+				return nil, fmt.Errorf("fixPodIP.multus prefix length %d is out of range 0-%d", prefix.length, prefix.bits)
+			}
+		}
+		return multusBackend{config.Multus}, nil
+	case CNICilium:
+		if config.Cilium.IPv4Annotation == "" && config.Cilium.IPv6Annotation == "" {
+			return nil, fmt.Errorf("fixPodIP.cilium.ipv4Annotation or ipv6Annotation is required when cni is %s", CNICilium)
+		}
+		return ciliumBackend{config.Cilium}, nil
+	case CNIKubeOVN:
+		return kubeOVNBackend{}, nil
+	}
+	return nil, fmt.Errorf("fixPodIP.cni '%s' is invalid, expected %s, %s, %s or %s", config.CNI, CNICalico, CNIMultus, CNICilium, CNIKubeOVN)
+}
+
+// 当前使用的CNI插件，预设配置不合法时使用calico
+func cniBackend() CNIBackend {
+	backend, err := newCNIBackend(CurrentPresetConfig().FixPodIP)
+	if err != nil {
+		log.Errorf("Create cni backend error, use %s: %v", CNICalico, err)
+		return calicoBackend{}
+	}
+	return backend
+}
+
+// Calico: cni.projectcalico.org/ipAddrs: '["10.10.10.101","fd00:10::101"]'
+type calicoBackend struct{}
+
+func (calicoBackend) Name() string {
+	return CNICalico
+}
+
+func (calicoBackend) SetPodIPs(pod *corev1.Pod, ips []string) error {
+	ipByte, err := json.Marshal(ips)
+	if err != nil {
+		return err
+	}
+	addAnnotation(pod, string(ipByte))
+	return nil
+}
+
+func (calicoBackend) PodIPs(pod *corev1.Pod) []string {
+	var ips []string
+	if v, ok := pod.Annotations[CalicoIPAddr]; ok && json.Unmarshal([]byte(v), &ips) == nil {
+		return ips
+	}
+	return nil
+}
+
+// Calico: cni.projectcalico.org/hwAddr: 0a:58:0a:0a:0a:65
+func (calicoBackend) SetPodMAC(pod *corev1.Pod, mac string) error {
+	setAnnotation(&pod.ObjectMeta, CalicoHwAddr, mac)
+	return nil
+}
+
+func (b calicoBackend) SetPodRoutes(*corev1.Pod, []fixedIPRoute) error {
+	return unsupported(b, "routes")
+}
+
+func (calicoBackend) PodMAC(pod *corev1.Pod) string {
+	return pod.Annotations[CalicoHwAddr]
+}
+
+// kube-ovn: ovn.kubernetes.io/ip_address: 10.10.10.101,fd00:10::101
+type kubeOVNBackend struct{}
+
+func (kubeOVNBackend) Name() string {
+	return CNIKubeOVN
+}
+
+func (kubeOVNBackend) SetPodIPs(pod *corev1.Pod, ips []string) error {
+	setAnnotation(&pod.ObjectMeta, KubeOVNIPAddress, strings.Join(ips, ","))
+	return nil
+}
+
+func (kubeOVNBackend) PodIPs(pod *corev1.Pod) []string {
+	if v, ok := pod.Annotations[KubeOVNIPAddress]; ok && v != "" {
+		return strings.Split(v, ",")
+	}
+	return nil
+}
+
+// kube-ovn: ovn.kubernetes.io/mac_address: 0a:58:0a:0a:0a:65
+func (kubeOVNBackend) SetPodMAC(pod *corev1.Pod, mac string) error {
+	setAnnotation(&pod.ObjectMeta, KubeOVNMACAddress, mac)
+	return nil
+}
+
+// kube-ovn: ovn.kubernetes.io/routes: '[{"dst":"192.168.0.0/16","gw":"10.10.10.1"}]'
+func (kubeOVNBackend) SetPodRoutes(pod *corev1.Pod, routes []fixedIPRoute) error {
+	routesByte, err := json.Marshal(routes)
+	if err != nil {
+		return err
+	}
+	setAnnotation(&pod.ObjectMeta, KubeOVNRoutes, string(routesByte))
+	return nil
+}
+
+func (kubeOVNBackend) PodMAC(pod *corev1.Pod) string {
+	return pod.Annotations[KubeOVNMACAddress]
+}
+
+// MultusOverride CNI为multus时的配置
+type MultusOverride struct {
+	// 指定IP的NetworkAttachmentDefinition，例如: macvlan 或 app/macvlan，其IPAM需要支持ips（例如static）
+	Network string `json:"network"`
+	// 网卡名称，可选
+	Interface string `json:"interface"`
+	// 写入ips时IP地址的前缀长度，为0时分别使用32和128
+	IPv4PrefixLength int `json:"ipv4PrefixLength"`
+	IPv6PrefixLength int `json:"ipv6PrefixLength"`
+}
+
+// Multus: k8s.v1.cni.cncf.io/networks: '[{"name":"macvlan","ips":["10.10.10.101/24"]}]'
+// Pod已经有networks注解时保留其他网络，简写格式（macvlan,app/sriov@net2）转换为JSON格式
+type multusBackend struct {
+	config MultusOverride
+}
+
+// Multus的NetworkSelectionElement，使用map原样保留没有用到的字段
+type multusNetwork map[string]interface{}
+
+func (multusBackend) Name() string {
+	return CNIMultus
+}
+
+// 网络的名称和命名空间，例如: app/macvlan
+func (b multusBackend) networkName() (string, string) {
+	if i := strings.Index(b.config.Network, "/"); i >= 0 {
+		return b.config.Network[i+1:], b.config.Network[:i]
+	}
+	return b.config.Network, ""
+}
+
+func (b multusBackend) match(network multusNetwork) bool {
+	name, namespace := b.networkName()
+	ns, _ := network["namespace"].(string)
+	return network["name"] == name && ns == namespace
+}
+
+// 解析networks注解，支持JSON格式和逗号分隔的简写格式
+func parseMultusNetworks(value string) ([]multusNetwork, error) {
+	value = strings.TrimSpace(value)
+	var networks []multusNetwork
+	if value == "" {
+		return networks, nil
+	}
+	if strings.HasPrefix(value, "[") {
+		if err := json.Unmarshal([]byte(value), &networks); err != nil {
+			return nil, fmt.Errorf("unmarshal '%s' error: %v", MultusNetworks, err)
+		}
+		return networks, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		network := multusNetwork{}
+		if i := strings.Index(item, "@"); i >= 0 {
+			network["interface"] = item[i+1:]
+			item = item[:i]
+		}
+		if i := strings.Index(item, "/"); i >= 0 {
+			network["namespace"] = item[:i]
+			item = item[i+1:]
+		}
+		network["name"] = item
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// 修改Pod的networks注解中配置的网络，没有时添加
+func (b multusBackend) updateNetwork(pod *corev1.Pod, update func(multusNetwork)) error {
+	networks, err := parseMultusNetworks(pod.Annotations[MultusNetworks])
+	if err != nil {
+		return err
+	}
+	var network multusNetwork
+	for _, n := range networks {
+		if b.match(n) {
+			network = n
+		}
+	}
+	if network == nil {
+		name, namespace := b.networkName()
+		network = multusNetwork{"name": name}
+		if namespace != "" {
+			network["namespace"] = namespace
+		}
+		networks = append(networks, network)
+	}
+	if b.config.Interface != "" {
+		network["interface"] = b.config.Interface
+	}
+	update(network)
+	networksByte, err := json.Marshal(networks)
+	if err != nil {
+		return err
+	}
+	setAnnotation(&pod.ObjectMeta, MultusNetworks, string(networksByte))
+	return nil
+}
+
+func (b multusBackend) SetPodIPs(pod *corev1.Pod, ips []string) error {
+	cidrs := make([]interface{}, 0, len(ips))
+	for _, ip := range ips {
+		length := b.config.IPv4PrefixLength
+		if IPFamily(ip) == IPv6 {
+			length = b.config.IPv6PrefixLength
+			if length == 0 {
+				length = 128
+			}
+		} else if length == 0 {
+			length = 32
+		}
+		cidrs = append(cidrs, ip+"/"+strconv.Itoa(length))
+	}
+	return b.updateNetwork(pod, func(network multusNetwork) {
+		network["ips"] = cidrs
+	})
+}
+
+// Multus: 网络的mac字段，NetworkAttachmentDefinition需要支持mac
+func (b multusBackend) SetPodMAC(pod *corev1.Pod, mac string) error {
+	return b.updateNetwork(pod, func(network multusNetwork) {
+		network["mac"] = mac
+	})
+}
+
+func (b multusBackend) SetPodRoutes(*corev1.Pod, []fixedIPRoute) error {
+	return unsupported(b, "routes")
+}
+
+func (b multusBackend) PodIPs(pod *corev1.Pod) []string {
+	networks, err := parseMultusNetworks(pod.Annotations[MultusNetworks])
+	if err != nil {
+		return nil
+	}
+	var ips []string
+	for _, network := range networks {
+		if !b.match(network) {
+			continue
+		}
+		cidrs, _ := network["ips"].([]interface{})
+		for _, cidr := range cidrs {
+			if s, ok := cidr.(string); ok {
+				if ip, _, err := net.ParseCIDR(s); err == nil {
+					ips = append(ips, ip.String())
+				} else {
+					ips = append(ips, s)
+				}
+			}
+		}
+	}
+	return ips
+}
+
+func (b multusBackend) PodMAC(pod *corev1.Pod) string {
+	networks, err := parseMultusNetworks(pod.Annotations[MultusNetworks])
+	if err != nil {
+		return ""
+	}
+	for _, network := range networks {
+		if mac, ok := network["mac"].(string); ok && b.match(network) {
+			return mac
+		}
+	}
+	return ""
+}
+
+// CiliumOverride CNI为cilium时的配置
+// Cilium的IPAM没有为Pod指定IP的标准注解，需要配置支持固定IP的IPAM所使用的注解
+type CiliumOverride struct {
+	IPv4Annotation string `json:"ipv4Annotation"`
+	IPv6Annotation string `json:"ipv6Annotation"`
+	// 指定MAC地址的注解，为空时不支持MAC地址
+	MACAnnotation string `json:"macAnnotation"`
+}
+
+// Cilium: 按地址族分别写入配置的注解
+type ciliumBackend struct {
+	config CiliumOverride
+}
+
+func (ciliumBackend) Name() string {
+	return CNICilium
+}
+
+func (b ciliumBackend) annotation(family string) string {
+	if family == IPv6 {
+		return b.config.IPv6Annotation
+	}
+	return b.config.IPv4Annotation
+}
+
+func (b ciliumBackend) SetPodIPs(pod *corev1.Pod, ips []string) error {
+	for _, ip := range ips {
+		family := IPFamily(ip)
+		key := b.annotation(family)
+		if key == "" {
+			return fmt.Errorf("%s address %s is not supported, fixPodIP.cilium has no %s annotation", family, ip, family)
+		}
+		setAnnotation(&pod.ObjectMeta, key, ip)
+	}
+	return nil
+}
+
+func (b ciliumBackend) PodIPs(pod *corev1.Pod) []string {
+	var ips []string
+	for _, family := range []string{IPv4, IPv6} {
+		if key := b.annotation(family); key != "" && pod.Annotations[key] != "" {
+			ips = append(ips, pod.Annotations[key])
+		}
+	}
+	return ips
+}
+
+func (b ciliumBackend) SetPodMAC(pod *corev1.Pod, mac string) error {
+	if b.config.MACAnnotation == "" {
+		return unsupported(b, "mac, fixPodIP.cilium has no mac annotation")
+	}
+	setAnnotation(&pod.ObjectMeta, b.config.MACAnnotation, mac)
+	return nil
+}
+
+func (b ciliumBackend) SetPodRoutes(*corev1.Pod, []fixedIPRoute) error {
+	return unsupported(b, "routes")
+}
+
+func (b ciliumBackend) PodMAC(pod *corev1.Pod) string {
+	if b.config.MACAnnotation == "" {
+		return ""
+	}
+	return pod.Annotations[b.config.MACAnnotation]
+}
@@ -0,0 +1,116 @@
+package impl
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+)
+
+func TestCNIBackend(t *testing.T) {
+	ips := []string{"10.10.10.101", "fd00:10::101"}
+	for _, c := range []struct {
+		config      FixPodIPOverride
+		annotations map[string]string
+		want        map[string]string
+	}{
+		{
+			config: FixPodIPOverride{},
+			want:   map[string]string{CalicoIPAddr: `["10.10.10.101","fd00:10::101"]`},
+		},
+		{
+			config: FixPodIPOverride{CNI: CNIKubeOVN},
+			want:   map[string]string{KubeOVNIPAddress: "10.10.10.101,fd00:10::101"},
+		},
+		{
+			config: FixPodIPOverride{CNI: CNICilium, Cilium: CiliumOverride{IPv4Annotation: "example.io/ipv4", IPv6Annotation: "example.io/ipv6"}},
+			want:   map[string]string{"example.io/ipv4": "10.10.10.101", "example.io/ipv6": "fd00:10::101"},
+		},
+		{
+			config: FixPodIPOverride{CNI: CNIMultus, Multus: MultusOverride{Network: "app/macvlan", IPv4PrefixLength: 24}},
+			want:   map[string]string{MultusNetworks: `[{"ips":["10.10.10.101/24","fd00:10::101/128"],"name":"macvlan","namespace":"app"}]`},
+		},
+		// 保留Pod已有的其他网络，简写格式转换为JSON格式
+		{
+			config:      FixPodIPOverride{CNI: CNIMultus, Multus: MultusOverride{Network: "macvlan", Interface: "net1"}},
+			annotations: map[string]string{MultusNetworks: "sriov@net2, macvlan"},
+			want:        map[string]string{MultusNetworks: `[{"interface":"net2","name":"sriov"},{"interface":"net1","ips":["10.10.10.101/32","fd00:10::101/128"],"name":"macvlan"}]`},
+		},
+	} {
+		backend, err := newCNIBackend(c.config)
+		if err != nil {
+			t.Fatalf("%+v: %v", c.config, err)
+		}
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations}}
+		if err := backend.SetPodIPs(pod, ips); err != nil {
+			t.Fatalf("%s: %v", backend.Name(), err)
+		}
+		if !reflect.DeepEqual(pod.Annotations, c.want) {
+			t.Errorf("%s: got annotations %v, want %v", backend.Name(), pod.Annotations, c.want)
+		}
+		if got := backend.PodIPs(pod); !reflect.DeepEqual(got, ips) {
+			t.Errorf("%s: got pod ips %v, want %v", backend.Name(), got, ips)
+		}
+	}
+
+	entry := fixedIPEntry{MAC: "0A:58:0A:0A:0A:65", Routes: []fixedIPRoute{{Dst: "192.168.0.0/16", Gw: "10.10.10.1"}}}
+	for _, c := range []struct {
+		config FixPodIPOverride
+		entry  fixedIPEntry
+		want   map[string]string
+	}{
+		{
+			config: FixPodIPOverride{},
+			entry:  fixedIPEntry{MAC: entry.MAC},
+			want:   map[string]string{CalicoHwAddr: "0a:58:0a:0a:0a:65"},
+		},
+		{
+			config: FixPodIPOverride{CNI: CNIKubeOVN},
+			entry:  entry,
+			want:   map[string]string{KubeOVNMACAddress: "0a:58:0a:0a:0a:65", KubeOVNRoutes: `[{"dst":"192.168.0.0/16","gw":"10.10.10.1"}]`},
+		},
+		{
+			config: FixPodIPOverride{CNI: CNIMultus, Multus: MultusOverride{Network: "macvlan"}},
+			entry:  fixedIPEntry{MAC: entry.MAC},
+			want:   map[string]string{MultusNetworks: `[{"mac":"0a:58:0a:0a:0a:65","name":"macvlan"}]`},
+		},
+	} {
+		backend, _ := newCNIBackend(c.config)
+		pod := &corev1.Pod{}
+		if err := setPodMACAndRoutes(backend, pod, c.entry); err != nil {
+			t.Fatalf("%s: %v", backend.Name(), err)
+		}
+		if !reflect.DeepEqual(pod.Annotations, c.want) {
+			t.Errorf("%s: got annotations %v, want %v", backend.Name(), pod.Annotations, c.want)
+		}
+		if mac := backend.PodMAC(pod); mac != "0a:58:0a:0a:0a:65" {
+			t.Errorf("%s: got pod mac %q", backend.Name(), mac)
+		}
+	}
+	// Calico和Multus不支持路由，Cilium未配置注解时不支持MAC地址
+	for _, config := range []FixPodIPOverride{
+		{},
+		{CNI: CNIMultus, Multus: MultusOverride{Network: "macvlan"}},
+		{CNI: CNICilium, Cilium: CiliumOverride{IPv4Annotation: "example.io/ipv4"}},
+	} {
+		backend, _ := newCNIBackend(config)
+		if err := setPodMACAndRoutes(backend, &corev1.Pod{}, entry); err == nil {
+			t.Errorf("%s: expected unsupported error", backend.Name())
+		}
+	}
+
+	backend, _ := newCNIBackend(FixPodIPOverride{CNI: CNICilium, Cilium: CiliumOverride{IPv4Annotation: "example.io/ipv4"}})
+	if err := backend.SetPodIPs(&corev1.Pod{}, ips); err == nil {
+		t.Error("cilium without ipv6 annotation should reject ipv6 address")
+	}
+	for _, config := range []FixPodIPOverride{
+		{CNI: "flannel"},
+		{CNI: CNIMultus},
+		{CNI: CNIMultus, Multus: MultusOverride{Network: "macvlan", IPv4PrefixLength: 33}},
+		{CNI: CNICilium},
+	} {
+		if _, err := newCNIBackend(config); err == nil {
+			t.Errorf("%+v: expected error", config)
+		}
+	}
+}
@@ -3,99 +3,62 @@ package impl
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/gin-gonic/gin"
-	"github.com/gin-gonic/gin/binding"
 	"github.com/open-kingfisher/king-utils/common/log"
-	"k8s.io/api/admission/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"strconv"
 	"strings"
-
-	"net/http"
 )
 
-func MutateEndpointExtendIp(c *gin.Context) {
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if err := c.ShouldBindBodyWith(&ar, binding.JSON); err != nil {
-		log.Errorf("Can't unmarshal body to AdmissionReview: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
-		c.JSON(http.StatusInternalServerError, err)
-		return
-	} else {
-		// mutate handle
-		admissionResponse = mutateExternalIp(&ar)
-		admissionReview := v1beta1.AdmissionReview{}
-		if admissionResponse != nil {
-			admissionReview.Response = admissionResponse
-			if ar.Request != nil {
-				admissionReview.Response.UID = ar.Request.UID
-			}
-		}
-		c.JSON(http.StatusOK, admissionReview)
-	}
+func init() {
+	Register(endpointExtendIP{})
 }
 
-func ValidateEndpointExtendIp(c *gin.Context) {
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if err := c.ShouldBindBodyWith(&ar, binding.JSON); err != nil {
-		log.Errorf("Can't unmarshal body to AdmissionReview: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
-		c.JSON(http.StatusInternalServerError, err)
-		return
-	} else {
-		// validate handle
-		admissionResponse = validateService(&ar)
-		admissionReview := v1beta1.AdmissionReview{}
-		if admissionResponse != nil {
-			admissionReview.Response = admissionResponse
-			if ar.Request != nil {
-				admissionReview.Response.UID = ar.Request.UID
-			}
-		}
-		c.JSON(http.StatusOK, admissionReview)
+// Service扩展外部IP和备份IP
+type endpointExtendIP struct{}
+
+func (endpointExtendIP) Name() string            { return "endpoint-extend-ip" }
+func (endpointExtendIP) Path() string            { return "endpointextendip" }
+func (endpointExtendIP) MutateKinds() []string   { return []string{"Endpoints"} }
+func (endpointExtendIP) ValidateKinds() []string { return []string{"Service"} }
+
+func (endpointExtendIP) Webhook() WebhookSpec {
+	return WebhookSpec{
+		Name: "endpoint.extend.ip",
+		ObjectSelector: &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{{
+				Key:      EndpointExtend,
+				Operator: metav1.LabelSelectorOpIn,
+				Values:   []string{EndpointExternalIPEnableLabels, EndpointBackupIPEnableLabels},
+			}},
+		},
+		MutateOperations:   []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		ValidateOperations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
 	}
 }
 
-func mutateExternalIp(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
-	var (
-		originalLabels map[string]string
-		patch          []patchOperation
-	)
+func (endpointExtendIP) Mutate(req *admissionv1.AdmissionRequest) *Result {
+	return mutateExternalIp(req)
+}
 
-	log.Infof("Mutate: AdmissionReview: Kind=%v, Namespace=%v Name=%v UID=%v patchOperation=%v UserInfo=%v",
-		req.Kind, req.Namespace, req.Name, req.UID, req.Operation, req.UserInfo)
+func (endpointExtendIP) Validate(req *admissionv1.AdmissionRequest) *Result {
+	return validateService(req)
+}
 
-	var endpoint corev1.Endpoints
-	switch req.Kind.Kind {
-	case "Endpoints":
-		if err := json.Unmarshal(req.Object.Raw, &endpoint); err != nil {
-			log.Errorf("Mutate: Can't unmarshal raw object to endpoint: %v", err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
-		}
-		log.Infof("Mutate: AdmissionReview Resource: %+v", endpoint)
-		originalLabels = endpoint.Labels
+func mutateExternalIp(req *admissionv1.AdmissionRequest) *Result {
+	var originalLabels map[string]string
 
-	default:
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
-		}
+	var endpoint corev1.Endpoints
+	if err := json.Unmarshal(req.Object.Raw, &endpoint); err != nil {
+		log.Errorf("Mutate: Can't unmarshal raw object to endpoint: %v", err)
+		return failed(err)
 	}
+	log.Infof("Mutate: AdmissionReview Resource: %+v", endpoint)
+	original := endpoint.DeepCopy()
+	originalLabels = endpoint.Labels
+
 	subset := corev1.EndpointSubset{
 		Addresses: []corev1.EndpointAddress{},
 		Ports:     []corev1.EndpointPort{},
@@ -104,11 +67,7 @@ func mutateExternalIp(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 		// 通过label获取ip
 		allowed, result, ipList := getIPByLabels(RequiredServiceExternalIPLabels, originalLabels)
 		if !allowed {
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: result,
-				},
-			}
+			return denied(result)
 		}
 		for _, ip := range ipList {
 			subset.Addresses = append(subset.Addresses, corev1.EndpointAddress{IP: ip})
@@ -116,11 +75,7 @@ func mutateExternalIp(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 		// 通过label获取端口
 		allowed, result, portList := getPortByLabels(RequiredServiceExternalPortLabels, originalLabels)
 		if !allowed {
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: result,
-				},
-			}
+			return denied(result)
 		}
 		for _, port := range portList {
 			subset.Ports = append(subset.Ports, corev1.EndpointPort{
@@ -128,31 +83,25 @@ func mutateExternalIp(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 				Port: int32(port["port"]),
 			})
 		}
-		patchSubset := addSubset(subset, len(endpoint.Subsets))
-		patch = append(patch, patchSubset)
+		addSubset(&endpoint, subset)
 	}
 
 	if originalLabels[EndpointExtend] == EndpointBackupIPEnableLabels {
 		// 通过label获取ip
 		allowed, result, backupIpList := getIPByLabels(RequiredServiceBackupIPLabels, originalLabels)
 		if !allowed {
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: result,
-				},
-			}
+			return denied(result)
 		}
-
-		if endpoint.Subsets != nil {
+		if original.Subsets != nil {
 			originalIP := make([]string, 0)
-			for _, subsets := range endpoint.Subsets {
+			for _, subsets := range original.Subsets {
 				for _, addresses := range subsets.Addresses {
 					originalIP = append(originalIP, addresses.IP)
 				}
 			}
 			// 原始IP和backupIP不相等的情况，才去移除，相等说明要启用backupIP
 			if !EqualSlice(originalIP, backupIpList) {
-				for addressesIndex, subsets := range endpoint.Subsets {
+				for addressesIndex, subsets := range original.Subsets {
 					patchAddresses := make([]corev1.EndpointAddress, 0)
 					for _, addresses := range subsets.Addresses {
 						state := func() bool {
@@ -172,109 +121,50 @@ func mutateExternalIp(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 						patchAddresses = append(patchAddresses, addresses)
 					}
 					if len(patchAddresses) != 0 {
-						patchSubset := replaceAddresses(patchAddresses, addressesIndex)
-						patch = append(patch, patchSubset)
+						replaceAddresses(&endpoint, patchAddresses, addressesIndex)
 					}
 				}
 			}
 		}
 	}
 
-	patchBytes, err := json.Marshal(patch)
-	if err != nil {
-		errorMassage := fmt.Sprintf("json.Marshal patch: '%+v' error: %s", patch, err)
-		log.Errorf(errorMassage)
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: errorMassage,
-			},
-		}
-	}
-
-	log.Infof("Mutate: AdmissionResponse Patch: %v\n", string(patchBytes))
-	// 当前仅支持patchType为JSONPatch的AdmissionResponse
-	return &v1beta1.AdmissionResponse{
-		Allowed: true,
-		Patch:   patchBytes,
-		PatchType: func() *v1beta1.PatchType { // 不用单独生成变量，直接命名函数返回
-			pt := v1beta1.PatchTypeJSONPatch
-			return &pt
-		}(),
-	}
+	return patchedDiff(original, &endpoint)
 }
 
-func validateService(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
-	var (
-		originalServiceLabels map[string]string
-		resourceName          string
-	)
-	log.Infof("Validate: AdmissionReview: Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-		req.Kind, req.Namespace, req.Name, resourceName, req.UID, req.Operation, req.UserInfo)
-
-	switch req.Kind.Kind {
-	case "Service":
-		var service corev1.Service
-		if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
-			log.Errorf("Validate: Can't unmarshal raw object to Service: %v", err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
-		}
-		resourceName = service.Name
-		// endpoint-external-ip: enabled
-		// 例如:  externalIP: "192.168.10.1-192.168.10.11"
-		// externalPort: "80-8080"
-		// endpoint-backup-ip: enabled
-		// backupIP: "192.168.10.1-192.168.10.11"
-		originalServiceLabels = service.Labels
-
-	default:
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
-		}
+func validateService(req *admissionv1.AdmissionRequest) *Result {
+	var service corev1.Service
+	if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
+		log.Errorf("Validate: Can't unmarshal raw object to Service: %v", err)
+		return failed(err)
 	}
+	// endpoint-external-ip: enabled
+	// 例如:  externalIP: "192.168.10.1-192.168.10.11"
+	// externalPort: "80-8080"
+	// endpoint-backup-ip: enabled
+	// backupIP: "192.168.10.1-192.168.10.11"
+	originalServiceLabels := service.Labels
 
 	log.Info("Validate: original service labels: ", originalServiceLabels)
 	// external ip 功能相关校验
 	if originalServiceLabels[EndpointExtend] == EndpointExternalIPEnableLabels {
 		// 校验externalIP是否存在，是否符合规定
 		if allowed, result := validateIP(RequiredServiceExternalIPLabels, originalServiceLabels); !allowed {
-			return &v1beta1.AdmissionResponse{
-				Allowed: allowed,
-				Result: &metav1.Status{
-					Reason: metav1.StatusReason(result),
-				},
-			}
+			return denied(result)
 		}
 		// 校验externalPort是否存在，是否符合规定
 		if allowed, result := validatePort(RequiredServiceExternalPortLabels, originalServiceLabels); !allowed {
-			return &v1beta1.AdmissionResponse{
-				Allowed: allowed,
-				Result: &metav1.Status{
-					Reason: metav1.StatusReason(result),
-				},
-			}
+			return denied(result)
 		}
 	}
 	// backup ip 相关功能
 	if originalServiceLabels[EndpointExtend] == EndpointBackupIPEnableLabels {
 		// 校验backupIP是否存在，是否符合规定
 		if allowed, result := validateIP(RequiredServiceBackupIPLabels, originalServiceLabels); !allowed {
-			return &v1beta1.AdmissionResponse{
-				Allowed: allowed,
-				Result: &metav1.Status{
-					Reason: metav1.StatusReason(result),
-				},
-			}
+			return denied(result)
 		}
 	}
 
-	return &v1beta1.AdmissionResponse{
-		Allowed: true,
-	}
+	return allowed()
 }
 
 // 校验IP是否存在，是否符合规定
@@ -0,0 +1,57 @@
+package impl
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	FailClosed = "fail-closed" // 内部错误时拒绝请求，默认
+	FailOpen   = "fail-open"   // 内部错误时放行请求，并在Warnings中说明
+)
+
+// 各预设的内部错误处理策略，未设置的预设使用FailClosed
+var failurePolicies = map[string]string{}
+
+// SetFailurePolicies 设置预设的内部错误处理策略
+// 格式: fix-pod-ip=fail-open,log-sidecar-inject=fail-closed
+func SetFailurePolicies(value string) error {
+	policies := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("failure policy '%s' format error. Example: fix-pod-ip=%s", item, FailOpen)
+		}
+		name, policy := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if !presetRegistered(name) {
+			return fmt.Errorf("failure policy '%s': preset '%s' is not registered", item, name)
+		}
+		if policy != FailOpen && policy != FailClosed {
+			return fmt.Errorf("failure policy '%s': policy must be '%s' or '%s'", item, FailOpen, FailClosed)
+		}
+		policies[name] = policy
+	}
+	failurePolicies = policies
+	return nil
+}
+
+// FailurePolicy 返回预设的内部错误处理策略
+func FailurePolicy(name string) string {
+	if policy, ok := failurePolicies[name]; ok {
+		return policy
+	}
+	return FailClosed
+}
+
+func presetRegistered(name string) bool {
+	for _, p := range presets {
+		if p.Name() == name {
+			return true
+		}
+	}
+	return false
+}
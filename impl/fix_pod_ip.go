@@ -1,249 +1,462 @@
 package impl
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/gin-gonic/gin"
-	"github.com/gin-gonic/gin/binding"
 	"github.com/open-kingfisher/king-utils/common/log"
-	"k8s.io/api/admission/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sort"
 	"strconv"
 	"strings"
-
-	"net/http"
 )
 
-func MutateFixPodIP(c *gin.Context) {
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if err := c.ShouldBindBodyWith(&ar, binding.JSON); err != nil {
-		log.Errorf("Can't unmarshal body to AdmissionReview: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
-		c.JSON(http.StatusInternalServerError, err)
-		return
-	} else {
-		// mutate handle
-		admissionResponse = mutate(&ar)
-		admissionReview := v1beta1.AdmissionReview{}
-		if admissionResponse != nil {
-			admissionReview.Response = admissionResponse
-			if ar.Request != nil {
-				admissionReview.Response.UID = ar.Request.UID
-			}
-		}
-		c.JSON(http.StatusOK, admissionReview)
+func init() {
+	Register(fixPodIP{})
+}
+
+// Pod IP地址固定
+type fixPodIP struct{}
+
+func (fixPodIP) Name() string          { return "fix-pod-ip" }
+func (fixPodIP) Path() string          { return "fixpodip" }
+func (fixPodIP) MutateKinds() []string { return []string{"Pod"} }
+func (fixPodIP) ValidateKinds() []string {
+	return []string{"StatefulSet", "Deployment", "ReplicaSet", "Scale"}
+}
+
+func (fixPodIP) Webhook() WebhookSpec {
+	return WebhookSpec{
+		Name: "fix.pod.ip",
+		ObjectSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{FixPodIPLabel: Enabled},
+		},
+		MutateOperations:   []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		ValidateOperations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		// IP池模式下mutate会租用IP，validate没有副作用，Deployment删除后由gcLeases删除租约
+		MutateSideEffects:   admissionregistrationv1.SideEffectClassNoneOnDryRun,
+		ValidateSideEffects: admissionregistrationv1.SideEffectClassNone,
+	}
+}
+
+func (fixPodIP) Mutate(req *admissionv1.AdmissionRequest) *Result {
+	return mutate(req)
+}
+
+func (fixPodIP) Validate(req *admissionv1.AdmissionRequest) *Result {
+	return validate(req)
+}
+
+// fix.pod.ip注解，key为Pod序号，value为节点和IP
+// 支持两种格式，列表按下标对应Pod序号: [{"node1":["10.0.0.1"]},{"node2":["10.0.0.2"]}]
+// 对象按key对应Pod序号，序号可以不连续: {"0":{"node1":["10.0.0.1"]},"2":{"node2":["10.0.0.2"]}}
+type fixedIPs map[int]map[string]fixedIPEntry
+
+// fix.pod.ip注解中一个Pod的地址，可以是IP列表，也可以是包含MAC地址和路由的对象
+// 例如: ["10.0.0.1"] 或 {"ips":["10.0.0.1"],"mac":"0a:58:0a:00:00:01","routes":[{"dst":"192.168.0.0/16","gw":"10.0.0.254"}]}
+type fixedIPEntry struct {
+	IPs    []string       `json:"ips"`
+	MAC    string         `json:"mac,omitempty"`
+	Routes []fixedIPRoute `json:"routes,omitempty"`
+}
+
+// Pod的路由，gw为空时使用默认网关
+type fixedIPRoute struct {
+	Dst string `json:"dst"`
+	Gw  string `json:"gw,omitempty"`
+}
+
+func (e *fixedIPEntry) UnmarshalJSON(data []byte) error {
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		*e = fixedIPEntry{}
+		return json.Unmarshal(data, &e.IPs)
+	}
+	// 不允许未知字段，避免写错字段名后MAC地址或路由没有生效
+	type entry fixedIPEntry
+	var v entry
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&v); err != nil {
+		return err
 	}
+	*e = fixedIPEntry(v)
+	return nil
 }
 
-func ValidateFixPodIP(c *gin.Context) {
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if err := c.ShouldBindBodyWith(&ar, binding.JSON); err != nil {
-		log.Errorf("Can't unmarshal body to AdmissionReview: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+func parseFixPodIP(value string) (fixedIPs, error) {
+	ip := fixedIPs{}
+	if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		ordinals := map[string]map[string]fixedIPEntry{}
+		if err := json.Unmarshal([]byte(value), &ordinals); err != nil {
+			return nil, err
 		}
-		c.JSON(http.StatusInternalServerError, err)
-		return
-	} else {
-		// validate handle
-		admissionResponse = validate(&ar)
-		admissionReview := v1beta1.AdmissionReview{}
-		if admissionResponse != nil {
-			admissionReview.Response = admissionResponse
-			if ar.Request != nil {
-				admissionReview.Response.UID = ar.Request.UID
+		for key, ipMap := range ordinals {
+			ordinal, err := strconv.Atoi(key)
+			if err != nil || ordinal < 0 || strconv.Itoa(ordinal) != key {
+				return nil, fmt.Errorf("invalid ordinal '%s'", key)
 			}
+			ip[ordinal] = ipMap
 		}
-		c.JSON(http.StatusOK, admissionReview)
+		return ip, nil
+	}
+	list := []map[string]fixedIPEntry{}
+	if err := json.Unmarshal([]byte(value), &list); err != nil {
+		return nil, err
 	}
+	for ordinal, ipMap := range list {
+		ip[ordinal] = ipMap
+	}
+	return ip, nil
 }
 
-func mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
+// 从小到大的Pod序号
+func (ip fixedIPs) ordinals() []int {
+	ordinals := make([]int, 0, len(ip))
+	for ordinal := range ip {
+		ordinals = append(ordinals, ordinal)
+	}
+	sort.Ints(ordinals)
+	return ordinals
+}
+
+func mutate(req *admissionv1.AdmissionRequest) *Result {
 	var (
 		originalAnnotations map[string]string
 		resourceName        string
 		generateName        string
-		patch               []patchOperation
 	)
 
-	log.Infof("Mutate: AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-		req.Kind, req.Namespace, req.Name, resourceName, req.UID, req.Operation, req.UserInfo)
-
-	switch req.Kind.Kind {
-	case "Pod":
-		var pod corev1.Pod
-		if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
-			log.Errorf("Mutate: Can't unmarshal raw object to pod: %v", err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
-		}
-		log.Infof("Mutate: AdmissionReview Resource: %+v", pod)
-		resourceName, generateName, originalAnnotations = pod.Name, pod.GenerateName, pod.Annotations
-	default:
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
-		}
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		log.Errorf("Mutate: Can't unmarshal raw object to pod: %v", err)
+		return failed(err)
 	}
+	log.Infof("Mutate: AdmissionReview Resource: %+v", pod)
+	original := pod.DeepCopy()
+	resourceName, generateName, originalAnnotations = pod.Name, pod.GenerateName, pod.Annotations
 
+	pinning, err := nodePinning(originalAnnotations)
+	if err != nil {
+		return denied("Mutate: " + err.Error())
+	}
+	backend := cniBackend()
+	// 使用FixedIPPool代替fix.pod.ip注解
+	if name, ok := originalAnnotations[FixPodIPPool]; ok {
+		return mutateFixedIPPool(req, original, &pod, name, pinning, backend)
+	}
 	if v, ok := originalAnnotations[RequiredPodAnnotations]; !ok {
 		log.Errorf("Required pod annotation '%s' are not set", RequiredPodAnnotations)
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: fmt.Sprintf("Mutate: Required pod annotation '%s' are not set", RequiredPodAnnotations),
-			},
-		}
+		return denied(fmt.Sprintf("Mutate: Required pod annotation '%s' are not set", RequiredPodAnnotations))
 	} else {
-		ip := []map[string][]string{}
-		if err := json.Unmarshal([]byte(v), &ip); err != nil {
-			errorMassage := fmt.Sprintf("Mutate: Unmarshal '%s' value error: %s", RequiredPodAnnotations, err)
-			log.Errorf(errorMassage)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: errorMassage,
-				},
-			}
+		if ip, err := parseFixPodIP(v); err != nil {
+			return denied(fmt.Sprintf("Mutate: Unmarshal '%s' value error: %s", RequiredPodAnnotations, err))
 		} else {
-			podNumString := strings.TrimPrefix(resourceName, generateName)
-			if podNum, err := strconv.Atoi(podNumString); err != nil {
-				errorMassage := fmt.Sprintf("Mutate: strconv.Atoi '%s' to int error: %s", podNumString, err)
-				log.Errorf(errorMassage)
-				return &v1beta1.AdmissionResponse{
-					Result: &metav1.Status{
-						Message: errorMassage,
-					},
+			var podNum int
+			if pool, ok := podPool(&pod); ok && req.Operation != admissionv1.Create {
+				// 只在CREATE时租用IP，UPDATE时继续使用注解中的租约，没有租约的Pod不修改，运行中的Pod不会更换IP
+				if podNum, ok = podLeaseIndex(&pod, pool, ip); !ok {
+					return patchedDiff(original, &pod)
 				}
-			} else {
-				ipMap := ip[podNum]
-				patchNodeName := make([]patchOperation, 0)
-				patchAnnotation := make([]patchOperation, 0)
-				for nodeName, ipAddr := range ipMap {
-					// 指定Pod的节点
-					patchNodeName = mutateNodeName(nodeName)
-					// 指定注解
-					if ipByte, err := json.Marshal(ipAddr); err != nil {
-						errorMassage := fmt.Sprintf("Mutate: json.Marshal ip address '%s' error: %s", ipAddr, err)
-						log.Errorf(errorMassage)
-						return &v1beta1.AdmissionResponse{
-							Result: &metav1.Status{
-								Message: errorMassage,
-							},
-						}
-					} else {
-						patchAnnotation = addAnnotation(string(ipByte))
+			} else if ok {
+				// Deployment和ReplicaSet创建的Pod名称不固定，从IP池中租用一个空闲的IP
+				if podNum, err = leasePodIP(req, &pod, pool, ip); err != nil {
+					if err == errPoolExhausted {
+						return denied(fmt.Sprintf("Mutate: No free ip in pool '%s', all %d ip are leased", pool, len(ip)))
 					}
+					return failed(fmt.Errorf("Mutate: lease ip from pool '%s' error: %v", pool, err))
+				}
+			} else {
+				podNumString := strings.TrimPrefix(resourceName, generateName)
+				if podNum, err = strconv.Atoi(podNumString); err != nil {
+					return denied(fmt.Sprintf("Mutate: strconv.Atoi '%s' to int error: %s", podNumString, err))
+				}
+			}
+			ipMap, ok := ip[podNum]
+			if !ok {
+				// 副本数增加后注解中没有对应的序号
+				return denied(fmt.Sprintf("Mutate: No entry for pod ordinal %d in '%s', add it before scaling up", podNum, RequiredPodAnnotations))
+			}
+			// 多个节点时遍历map的顺序不固定，每次请求的结果可能不同，与validate的检查保持一致
+			if len(ipMap) != 1 {
+				return denied(fmt.Sprintf("Mutate: '%s' of pod ordinal %d: must have exactly one node, got %d", RequiredPodAnnotations, podNum, len(ipMap)))
+			}
+			for nodeName, entry := range ipMap {
+				// 指定Pod的节点，Pod创建后spec不能修改，只在CREATE时指定
+				if req.Operation == admissionv1.Create {
+					pinPodToNode(&pod, nodeName, pinning)
+				}
+				ipAddr, err := podIPAddrs(entry.IPs)
+				if err != nil {
+					return denied(fmt.Sprintf("Mutate: '%s' of pod ordinal %d: %s", RequiredPodAnnotations, podNum, err))
 				}
-				patch = append(patch, patchNodeName...)
-				patch = append(patch, patchAnnotation...)
+				// 通过CNI插件的注解指定IP
+				if err := backend.SetPodIPs(&pod, ipAddr); err != nil {
+					return denied(fmt.Sprintf("Mutate: Set ip address %v for cni %s error: %s", ipAddr, backend.Name(), err))
+				}
+				if err := setPodMACAndRoutes(backend, &pod, entry); err != nil {
+					return denied(fmt.Sprintf("Mutate: '%s' of pod ordinal %d: %s", RequiredPodAnnotations, podNum, err))
+				}
+			}
+		}
+	}
+	return patchedDiff(original, &pod)
+}
+
+// Pod固定到节点的方式，注解优先，其次是预设配置中的默认方式
+func nodePinning(annotations map[string]string) (string, error) {
+	if pinning, ok := annotations[FixPodIPNodePinning]; ok {
+		if !CheckNodePinning(pinning) {
+			return "", fmt.Errorf("'%s' value '%s' is invalid, expected nodeName, nodeAffinity, nodeSelector or none", FixPodIPNodePinning, pinning)
+		}
+		return pinning, nil
+	}
+	if pinning := CurrentPresetConfig().FixPodIP.NodePinning; pinning != "" {
+		return pinning, nil
+	}
+	return NodePinningNodeName, nil
+}
+
+// Pod注解中记录的租约对应的序号
+func podLeaseIndex(pod *corev1.Pod, pool string, ip fixedIPs) (int, bool) {
+	if leasePool, key, ok := parsePodLease(pod); ok && leasePool == pool {
+		if index, err := strconv.Atoi(key); err == nil {
+			if _, ok := ip[index]; ok {
+				return index, true
 			}
 		}
 	}
+	return 0, false
+}
+
+// Pod从IP池中租用IP，已经租用过的Pod继续使用原来的IP
+func leasePodIP(req *admissionv1.AdmissionRequest, pod *corev1.Pod, pool string, ip fixedIPs) (int, error) {
+	if index, ok := podLeaseIndex(pod, pool, ip); ok {
+		return index, nil
+	}
+	dryRun := req.DryRun != nil && *req.DryRun
+	index, err := leaseIP(req.Namespace, pool, ip.ordinals(), dryRun)
+	if err != nil {
+		return 0, err
+	}
+	setAnnotation(&pod.ObjectMeta, FixPodIPLease, fmt.Sprintf("%s/%d", pool, index))
+	return index, nil
+}
 
-	patchBytes, err := json.Marshal(patch)
+// 从FixedIPPool中租用IP，IP指定了节点时同时指定Pod的节点
+func mutateFixedIPPool(req *admissionv1.AdmissionRequest, original, pod *corev1.Pod, name, pinning string, backend CNIBackend) *Result {
+	address, err := leaseFixedIP(pod, name, req.DryRun != nil && *req.DryRun)
+	if err == errPoolExhausted {
+		return denied(fmt.Sprintf("Mutate: No free ip in FixedIPPool '%s'", name))
+	} else if denial, ok := err.(poolDenied); ok {
+		return denied("Mutate: " + denial.Error())
+	} else if err != nil {
+		return failed(fmt.Errorf("Mutate: lease ip from FixedIPPool '%s' error: %v", name, err))
+	}
+	if address.Node != "" && req.Operation == admissionv1.Create {
+		pinPodToNode(pod, address.Node, pinning)
+	}
+	if err := backend.SetPodIPs(pod, []string{canonicalIP(address.IP)}); err != nil {
+		return denied(fmt.Sprintf("Mutate: Set ip address %s for cni %s error: %s", address.IP, backend.Name(), err))
+	}
+	setAnnotation(&pod.ObjectMeta, FixPodIPLease, name+"/"+address.IP)
+	return patchedDiff(original, pod)
+}
+
+// 固定IP的工作负载：StatefulSet、Deployment或ReplicaSet
+type workload struct {
+	meta     *metav1.ObjectMeta
+	template *corev1.PodTemplateSpec
+	replicas *int32
+	surge    int32 // 滚动更新时最多超出副本数的Pod数量，新旧Pod同时租用IP
+}
+
+// Deployment滚动更新时的maxSurge，Recreate策略为0，未设置时使用默认的25%
+func deploymentSurge(deployment *appsv1.Deployment) int32 {
+	if deployment.Spec.Strategy.Type == appsv1.RecreateDeploymentStrategyType {
+		return 0
+	}
+	maxSurge := intstr.FromString("25%")
+	if rollingUpdate := deployment.Spec.Strategy.RollingUpdate; rollingUpdate != nil && rollingUpdate.MaxSurge != nil {
+		maxSurge = *rollingUpdate.MaxSurge
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	surge, err := intstr.GetValueFromIntOrPercent(&maxSurge, int(replicas), true)
 	if err != nil {
-		errorMassage := fmt.Sprintf("json.Marshal patch: '%s' error: %s", patch, err)
-		log.Errorf(errorMassage)
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: errorMassage,
-			},
+		return 0
+	}
+	return int32(surge)
+}
+
+// 从StatefulSet、Deployment和ReplicaSet中获取Pod模板和副本数
+func decodeWorkload(req *admissionv1.AdmissionRequest) (*workload, error) {
+	switch req.Kind.Kind {
+	case "Deployment":
+		var deployment appsv1.Deployment
+		if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
+			return nil, err
 		}
+		return &workload{&deployment.ObjectMeta, &deployment.Spec.Template, deployment.Spec.Replicas, deploymentSurge(&deployment)}, nil
+	case "ReplicaSet":
+		var replicaSet appsv1.ReplicaSet
+		if err := json.Unmarshal(req.Object.Raw, &replicaSet); err != nil {
+			return nil, err
+		}
+		return &workload{&replicaSet.ObjectMeta, &replicaSet.Spec.Template, replicaSet.Spec.Replicas, 0}, nil
+	default:
+		var sts appsv1.StatefulSet
+		if err := json.Unmarshal(req.Object.Raw, &sts); err != nil {
+			return nil, err
+		}
+		return &workload{&sts.ObjectMeta, &sts.Spec.Template, sts.Spec.Replicas, 0}, nil
+	}
+}
+
+// kubectl scale修改StatefulSet的scale子资源，使用StatefulSet的Pod模板和新的副本数检查
+// Scale对象没有标签，需要根据StatefulSet的标签判断是否开启了fix-pod-ip
+func validateScale(req *admissionv1.AdmissionRequest) *Result {
+	if req.Resource.Resource != "statefulsets" {
+		return allowed()
+	}
+	var scale autoscalingv1.Scale
+	if err := json.Unmarshal(req.Object.Raw, &scale); err != nil {
+		log.Errorf("Validate: Can't unmarshal raw object to Scale: %v", err)
+		return failed(err)
 	}
+	sts, err := getStatefulSet(req.Namespace, req.Name)
+	if errors.IsNotFound(err) {
+		return allowed()
+	} else if err != nil {
+		return failed(fmt.Errorf("Validate: get StatefulSet '%s' error: %v", req.Name, err))
+	}
+	if sts.Labels[FixPodIPLabel] != Enabled {
+		return allowed()
+	}
+	return validateWorkload(req, "StatefulSet", &workload{&sts.ObjectMeta, &sts.Spec.Template, &scale.Spec.Replicas, 0})
+}
 
-	log.Infof("Mutate: AdmissionResponse: patch=%v\n", string(patchBytes))
-	// 当前仅支持patchType为JSONPatch的AdmissionResponse
-	return &v1beta1.AdmissionResponse{
-		Allowed: true,
-		Patch:   patchBytes,
-		PatchType: func() *v1beta1.PatchType {
-			pt := v1beta1.PatchTypeJSONPatch
-			return &pt
-		}(),
+// 优先从缓存中获取开启了fix-pod-ip的StatefulSet，缓存中不存在说明没有开启
+func getStatefulSet(namespace, name string) (*appsv1.StatefulSet, error) {
+	if statefulSetLister != nil {
+		return statefulSetLister.StatefulSets(namespace).Get(name)
+	}
+	client, err := K8SClient()
+	if err != nil {
+		return nil, err
 	}
+	return client.AppsV1().StatefulSets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
 }
 
-func validate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
+func validate(req *admissionv1.AdmissionRequest) *Result {
+	// 之前注册的Webhook配置可能仍然发送DELETE请求，租约由gcLeases在工作负载删除后回收
+	if req.Operation == admissionv1.Delete {
+		return allowed()
+	}
+	if req.Kind.Kind == "Scale" {
+		return validateScale(req)
+	}
+	object, err := decodeWorkload(req)
+	if err != nil {
+		log.Errorf("Validate: Can't unmarshal raw object to %s: %v", req.Kind.Kind, err)
+		return failed(err)
+	}
+	return validateWorkload(req, req.Kind.Kind, object)
+}
+
+// 检查工作负载的Pod模板注解和副本数
+func validateWorkload(req *admissionv1.AdmissionRequest, kind string, object *workload) *Result {
 	var (
 		originalPodAnnotations map[string]string
-		resourceName           string
 		replicas               *int32
 	)
 
-	log.Infof("Validate: AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-		req.Kind, req.Namespace, req.Name, resourceName, req.UID, req.Operation, req.UserInfo)
+	// 获取Pod模板注解，里面应该有此次固定IP的地址
+	// 例如: fixed.pod.ip: "[{\"node1\":\"192.168.101.10\"},{\"node2\":\"192.168.102.10\"},{\"node3\":\"192.168.103.10\"}]"
+	originalPodAnnotations = object.template.Annotations
+	replicas = object.replicas
 
-	switch req.Kind.Kind {
-	case "StatefulSet":
-		var sts appsv1.StatefulSet
-		if err := json.Unmarshal(req.Object.Raw, &sts); err != nil {
-			log.Errorf("Validate: Can't unmarshal raw object to StatefulSet: %v", err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+	if _, err := nodePinning(originalPodAnnotations); err != nil {
+		return denied("Validate: " + err.Error())
+	}
+
+	// 使用FixedIPPool时副本数不能超过池中IP的数量
+	if name, ok := originalPodAnnotations[FixPodIPPool]; ok {
+		size, err := fixedIPPoolSize(req.Namespace, name)
+		if denial, ok := err.(poolDenied); ok {
+			return denied("Validate: " + denial.Error())
+		} else if err != nil {
+			return failed(err)
 		}
-		resourceName = sts.Name
-		// 获取StatefulSet下Pod模板注解，里面应该有此次固定IP的地址
-		// 例如: fixed.pod.ip: "[{\"node1\":\"192.168.101.10\"},{\"node2\":\"192.168.102.10\"},{\"node3\":\"192.168.103.10\"}]"
-		originalPodAnnotations = sts.Spec.Template.Annotations
-		// 获取StatefulSet副本数
-		replicas = sts.Spec.Replicas
-	default:
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
+		if replicas == nil {
+			return denied("Validate: Replicas is empty")
+		}
+		if size < int(*replicas) {
+			return denied(fmt.Sprintf("Validate: Replicas count must %d less than or equal to FixedIPPool '%s' ip count %d", *replicas, name, size))
 		}
+		if size < int(*replicas+object.surge) {
+			return denied(fmt.Sprintf("Validate: Replicas count %d plus maxSurge %d must be less than or equal to FixedIPPool '%s' ip count %d, set maxSurge to 0 or use the Recreate strategy", *replicas, object.surge, name, size))
+		}
+		return allowed()
 	}
 
-	allowed := true
-	var result *metav1.Status
 	log.Info("original pod annotations: ", originalPodAnnotations)
 	log.Info("required pod annotations: ", RequiredPodAnnotations)
 	if v, ok := originalPodAnnotations[RequiredPodAnnotations]; !ok {
-		allowed = false
-		result = &metav1.Status{
-			Reason: metav1.StatusReason(fmt.Sprintf("Validate: Required pod annotation '%s' are not set", RequiredPodAnnotations)),
-		}
+		return denied(fmt.Sprintf("Validate: Required pod annotation '%s' are not set", RequiredPodAnnotations))
 	} else {
-		ip := []map[string][]string{}
-		if err := json.Unmarshal([]byte(v), &ip); err != nil {
-			allowed = false
-			result = &metav1.Status{
-				Reason: metav1.StatusReason(fmt.Sprintf("Validate: Unmarshal '%s' value error: %s", RequiredPodAnnotations, err)),
-			}
+		if ip, err := parseFixPodIP(v); err != nil {
+			return denied(fmt.Sprintf("Validate: Unmarshal '%s' value error: %s", RequiredPodAnnotations, err))
 		} else {
 			if replicas == nil {
-				allowed = false
-				result = &metav1.Status{
-					Reason: metav1.StatusReason(fmt.Sprintf("Validate: Replicas is empty")),
-				}
+				return denied("Validate: Replicas is empty")
 			} else {
 				// 副本数量必须小于所提供的IP数量
 				if len(ip) < int(*replicas) {
-					allowed = false
-					result = &metav1.Status{
-						Reason: metav1.StatusReason(fmt.Sprintf("Validate: Replicas count must %d less than or equal to ip count %d", *replicas, len(ip))),
+					return denied(fmt.Sprintf("Validate: Replicas count must %d less than or equal to ip count %d", *replicas, len(ip)))
+				}
+				// Deployment滚动更新时新旧Pod同时租用IP，IP数量不足时新Pod无法创建，滚动更新无法继续
+				if len(ip) < int(*replicas+object.surge) {
+					return denied(fmt.Sprintf("Validate: Replicas count %d plus maxSurge %d must be less than or equal to ip count %d, set maxSurge to 0 or use the Recreate strategy", *replicas, object.surge, len(ip)))
+				}
+				// StatefulSet每个序号的Pod都必须有对应的IP
+				if kind == "StatefulSet" {
+					for ordinal := 0; ordinal < int(*replicas); ordinal++ {
+						if _, ok := ip[ordinal]; !ok {
+							return denied(fmt.Sprintf("Validate: No entry for pod ordinal %d in '%s', replicas %d", ordinal, RequiredPodAnnotations, *replicas))
+						}
 					}
 				}
 			}
+			// 检查注解中的节点和IP
+			if problems, err := checkFixPodIP(ip); err != nil {
+				return failed(fmt.Errorf("Validate: check '%s' error: %v", RequiredPodAnnotations, err))
+			} else if len(problems) != 0 {
+				return denied("Validate: " + strings.Join(problems, "; "))
+			}
+			// IP不能被其他工作负载或者运行中的Pod使用
+			owner := workloadOwner(kind, req.Namespace, object.meta)
+			if ip, usedBy, err := findIPConflict(owner, annotationIPs(ip)); err != nil {
+				return failed(fmt.Errorf("Validate: check ip conflict error: %v", err))
+			} else if usedBy != "" {
+				return denied(fmt.Sprintf("Validate: IP %s of %s is already used by %s", ip, owner, usedBy))
+			}
+			// MAC地址同样不能被其他工作负载或者运行中的Pod使用
+			if mac, usedBy, err := findMACConflict(owner, annotationMACs(ip)); err != nil {
+				return failed(fmt.Errorf("Validate: check mac conflict error: %v", err))
+			} else if usedBy != "" {
+				return denied(fmt.Sprintf("Validate: MAC %s of %s is already used by %s", mac, owner, usedBy))
+			}
 		}
 	}
-	return &v1beta1.AdmissionResponse{
-		Allowed: allowed,
-		Result:  result,
-	}
+	return allowed()
 }
@@ -0,0 +1,178 @@
+package impl
+
+import (
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"net"
+)
+
+// CalicoIPPoolResource Calico的IPPool，fix.pod.ip中的IP必须在启用的IPPool中
+var CalicoIPPoolResource = schema.GroupVersionResource{Group: "crd.projectcalico.org", Version: "v1", Resource: "ippools"}
+
+// 启用的Calico IPPool，CNI插件不是Calico、未安装Calico、informer未启动或者没有IPPool时返回nil，不检查IP范围
+func calicoIPPools() ([]*net.IPNet, error) {
+	if cniBackend().Name() != CNICalico || calicoIPPoolLister == nil {
+		return nil, nil
+	}
+	objs, err := calicoIPPoolLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var pools []*net.IPNet
+	for _, obj := range objs {
+		item, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		if disabled, _, _ := unstructured.NestedBool(item.Object, "spec", "disabled"); disabled {
+			continue
+		}
+		cidr, _, _ := unstructured.NestedString(item.Object, "spec", "cidr")
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			pools = append(pools, ipNet)
+		}
+	}
+	return pools, nil
+}
+
+// 节点是否存在，informer未启动时不检查
+func nodeExists(name string) (bool, error) {
+	if nodeLister == nil {
+		return true, nil
+	}
+	_, err := nodeLister.Get(name)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 检查fix.pod.ip注解的每一项：只能有一个节点，节点必须存在，IP必须合法、不能重复，并且在Calico IPPool中
+// MAC地址必须合法、不能重复，路由必须合法，并且CNI插件支持MAC地址和路由
+// 返回每一项的错误信息，为空表示检查通过
+func checkFixPodIP(ip fixedIPs) ([]string, error) {
+	pools, err := calicoIPPools()
+	if err != nil {
+		return nil, fmt.Errorf("list calico ippools error: %v", err)
+	}
+	backend := cniBackend()
+	var problems []string
+	seen := make(map[string]int)
+	seenMAC := make(map[string]int)
+	for _, index := range ip.ordinals() {
+		ipMap := ip[index]
+		prefix := fmt.Sprintf("%s[%d]", RequiredPodAnnotations, index)
+		if len(ipMap) != 1 {
+			problems = append(problems, fmt.Sprintf("%s: must have exactly one node, got %d", prefix, len(ipMap)))
+			continue
+		}
+		for nodeName, entry := range ipMap {
+			if exists, err := nodeExists(nodeName); err != nil {
+				return nil, fmt.Errorf("get node '%s' error: %v", nodeName, err)
+			} else if !exists {
+				problems = append(problems, fmt.Sprintf("%s: node '%s' not found", prefix, nodeName))
+			}
+			if len(entry.IPs) == 0 {
+				problems = append(problems, fmt.Sprintf("%s: node '%s' has no ip", prefix, nodeName))
+			}
+			families := make(map[string]string)
+			for _, addr := range entry.IPs {
+				family := IPFamily(addr)
+				if family == "" {
+					problems = append(problems, fmt.Sprintf("%s: invalid ip '%s'", prefix, addr))
+					continue
+				}
+				if other, ok := seen[canonicalIP(addr)]; ok {
+					problems = append(problems, fmt.Sprintf("%s: duplicate ip %s, already in %s[%d]", prefix, addr, RequiredPodAnnotations, other))
+					continue
+				}
+				seen[canonicalIP(addr)] = index
+				// 双栈时每个地址族最多一个IP
+				if other, ok := families[family]; ok {
+					problems = append(problems, fmt.Sprintf("%s: more than one %s address, %s and %s", prefix, family, other, addr))
+					continue
+				}
+				families[family] = addr
+				if len(pools) != 0 && !inIPPools(net.ParseIP(addr), pools) {
+					problems = append(problems, fmt.Sprintf("%s: ip %s is not in any calico ippool", prefix, addr))
+				}
+			}
+			count := len(problems)
+			if entry.MAC != "" {
+				if mac, err := canonicalMAC(entry.MAC); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %v", prefix, err))
+				} else if other, ok := seenMAC[mac]; ok {
+					problems = append(problems, fmt.Sprintf("%s: duplicate mac %s, already in %s[%d]", prefix, entry.MAC, RequiredPodAnnotations, other))
+				} else {
+					seenMAC[mac] = index
+				}
+			}
+			for _, route := range entry.Routes {
+				if err := checkRoute(route); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %v", prefix, err))
+				}
+			}
+			// MAC地址和路由合法时检查CNI插件是否支持
+			if len(problems) == count {
+				if err := setPodMACAndRoutes(backend, &corev1.Pod{}, entry); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %v", prefix, err))
+				}
+			}
+		}
+	}
+	return problems, nil
+}
+
+// Pod的IP地址，最多一个IPv4地址和一个IPv6地址，转换为标准格式并且IPv4在前，Calico双栈时按此格式指定IP
+func podIPAddrs(addrs []string) ([]string, error) {
+	families := make(map[string]string)
+	for _, addr := range addrs {
+		family := IPFamily(addr)
+		if family == "" {
+			return nil, fmt.Errorf("invalid ip '%s'", addr)
+		}
+		if other, ok := families[family]; ok {
+			return nil, fmt.Errorf("more than one %s address, %s and %s", family, other, addr)
+		}
+		families[family] = canonicalIP(addr)
+	}
+	var ips []string
+	for _, family := range []string{IPv4, IPv6} {
+		if ip, ok := families[family]; ok {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// 路由的目的网段必须是CIDR，网关必须是IP并且和目的网段的地址族相同
+func checkRoute(route fixedIPRoute) error {
+	_, dst, err := net.ParseCIDR(route.Dst)
+	if err != nil {
+		return fmt.Errorf("invalid route dst '%s'", route.Dst)
+	}
+	if route.Gw == "" {
+		return nil
+	}
+	family := IPFamily(route.Gw)
+	if family == "" {
+		return fmt.Errorf("invalid route gw '%s'", route.Gw)
+	}
+	if (dst.IP.To4() != nil) != (family == IPv4) {
+		return fmt.Errorf("route gw %s and dst %s are not in the same ip family", route.Gw, route.Dst)
+	}
+	return nil
+}
+
+func inIPPools(ip net.IP, pools []*net.IPNet) bool {
+	for _, pool := range pools {
+		if pool.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
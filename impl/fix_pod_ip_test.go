@@ -0,0 +1,31 @@
+package impl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFixPodIP(t *testing.T) {
+	want := fixedIPs{0: {"node01": {IPs: []string{"10.10.10.101"}}}, 2: {"node03": {IPs: []string{"10.10.10.103"}}}}
+	got, err := parseFixPodIP(` {"0":{"node01":["10.10.10.101"]},"2":{"node03":["10.10.10.103"]}}`)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("object form: got %v %v, want %v", got, err, want)
+	}
+	if ordinals := got.ordinals(); !reflect.DeepEqual(ordinals, []int{0, 2}) {
+		t.Errorf("ordinals: got %v", ordinals)
+	}
+	got, err = parseFixPodIP(`[{"node01":["10.10.10.101"]},{"node02":["10.10.10.102"]}]`)
+	if err != nil || len(got) != 2 || got[1]["node02"].IPs[0] != "10.10.10.102" {
+		t.Errorf("list form: got %v %v", got, err)
+	}
+	// 包含MAC地址和路由的对象
+	got, err = parseFixPodIP(`[{"node01":{"ips":["10.10.10.101"],"mac":"0a:58:0a:0a:0a:65","routes":[{"dst":"192.168.0.0/16","gw":"10.10.10.1"}]}}]`)
+	if entry := got[0]["node01"]; err != nil || entry.IPs[0] != "10.10.10.101" || entry.MAC != "0a:58:0a:0a:0a:65" || len(entry.Routes) != 1 || entry.Routes[0].Gw != "10.10.10.1" {
+		t.Errorf("entry with mac and routes: got %+v %v", got, err)
+	}
+	for _, value := range []string{`{"a":{}}`, `{"-1":{}}`, `{"01":{}}`, `"10.10.10.101"`, `[{"node01":{"ips":["10.10.10.101"],"hwAddr":"0a:58:0a:0a:0a:65"}}]`} {
+		if _, err := parseFixPodIP(value); err == nil {
+			t.Errorf("parseFixPodIP(%s) expected error", value)
+		}
+	}
+}
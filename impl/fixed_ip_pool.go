@@ -0,0 +1,289 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/retry"
+	"net"
+)
+
+const (
+	FixPodIPPool       = "fix.pod.ip.pool" // Pod模板注解，使用同一命名空间下的FixedIPPool代替fix.pod.ip
+	MaxFixedIPPoolSize = 65536             // CIDR最多展开的IP数量
+)
+
+// FixedIPPoolResource FixedIPPool自定义资源，CRD见deployment/crd_fixed_ip_pool.yaml
+var FixedIPPoolResource = schema.GroupVersionResource{Group: "preset.kingfisher.io", Version: "v1alpha1", Resource: "fixedippools"}
+
+// FixedIPPool 固定IP池，Pod通过fix.pod.ip.pool注解从中租用IP
+type FixedIPPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              FixedIPPoolSpec   `json:"spec"`
+	Status            FixedIPPoolStatus `json:"status,omitempty"`
+}
+
+// FixedIPPoolSpec cidr和ips只能设置一个
+type FixedIPPoolSpec struct {
+	CIDR string    `json:"cidr,omitempty"` // 例如: 10.10.10.0/28，不包含网络地址和广播地址
+	IPs  []FixedIP `json:"ips,omitempty"`
+}
+
+// FixedIP 池中的IP，node不为空时Pod只能调度到该节点
+type FixedIP struct {
+	IP   string `json:"ip"`
+	Node string `json:"node,omitempty"`
+}
+
+// FixedIPPoolStatus 记录每个IP被哪个Pod租用
+type FixedIPPoolStatus struct {
+	Leases []FixedIPLease `json:"leases,omitempty"`
+}
+
+// FixedIPLease pod为空表示Pod尚未创建完成
+type FixedIPLease struct {
+	IP   string      `json:"ip"`
+	Pod  string      `json:"pod,omitempty"`
+	Time metav1.Time `json:"time"`
+}
+
+// 需要拒绝请求的IP池错误，例如IP池不存在或者配置错误
+type poolDenied string
+
+func (e poolDenied) Error() string { return string(e) }
+
+// 池中所有的IP
+func (p *FixedIPPool) addresses() ([]FixedIP, error) {
+	if p.Spec.CIDR != "" && len(p.Spec.IPs) != 0 {
+		return nil, poolDenied(fmt.Sprintf("FixedIPPool '%s': only one of cidr and ips can be set", p.Name))
+	}
+	if p.Spec.CIDR == "" {
+		seen := make(map[string]bool, len(p.Spec.IPs))
+		for _, address := range p.Spec.IPs {
+			if net.ParseIP(address.IP) == nil {
+				return nil, poolDenied(fmt.Sprintf("FixedIPPool '%s': invalid ip '%s'", p.Name, address.IP))
+			}
+			if seen[address.IP] {
+				return nil, poolDenied(fmt.Sprintf("FixedIPPool '%s': duplicate ip '%s'", p.Name, address.IP))
+			}
+			seen[address.IP] = true
+		}
+		return p.Spec.IPs, nil
+	}
+	_, ipNet, err := net.ParseCIDR(p.Spec.CIDR)
+	if err != nil {
+		return nil, poolDenied(fmt.Sprintf("FixedIPPool '%s': invalid cidr '%s'", p.Name, p.Spec.CIDR))
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones > 16 {
+		return nil, poolDenied(fmt.Sprintf("FixedIPPool '%s': cidr '%s' has more than %d ip", p.Name, p.Spec.CIDR, MaxFixedIPPoolSize))
+	}
+	var addresses []FixedIP
+	for ip := ipNet.IP; ipNet.Contains(ip); ip = nextIP(ip) {
+		addresses = append(addresses, FixedIP{IP: ip.String()})
+	}
+	// IPv4不使用网络地址和广播地址
+	if ipNet.IP.To4() != nil && bits-ones > 1 {
+		addresses = addresses[1 : len(addresses)-1]
+	}
+	return addresses, nil
+}
+
+// 下一个IP地址，溢出时返回nil
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+func getFixedIPPool(namespace, name string) (*FixedIPPool, error) {
+	client, err := DynamicClient()
+	if err != nil {
+		return nil, err
+	}
+	obj, err := client.Resource(FixedIPPoolResource).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, poolDenied(fmt.Sprintf("FixedIPPool '%s' not found in namespace '%s'", name, namespace))
+	} else if err != nil {
+		return nil, err
+	}
+	return toFixedIPPool(obj)
+}
+
+// 转换dynamic client或者informer返回的FixedIPPool
+func toFixedIPPool(obj runtime.Object) (*FixedIPPool, error) {
+	item, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected FixedIPPool object %T", obj)
+	}
+	pool := &FixedIPPool{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, pool); err != nil {
+		return nil, fmt.Errorf("convert FixedIPPool %s/%s error: %v", item.GetNamespace(), item.GetName(), err)
+	}
+	return pool, nil
+}
+
+func updateFixedIPPoolStatus(pool *FixedIPPool) error {
+	client, err := DynamicClient()
+	if err != nil {
+		return err
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		return err
+	}
+	_, err = client.Resource(FixedIPPoolResource).Namespace(pool.Namespace).UpdateStatus(context.TODO(), &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	return err
+}
+
+// FixedIPPool中IP的数量
+func fixedIPPoolSize(namespace, name string) (int, error) {
+	pool, err := getFixedIPPool(namespace, name)
+	if err != nil {
+		return 0, err
+	}
+	addresses, err := pool.addresses()
+	return len(addresses), err
+}
+
+// 从FixedIPPool中为Pod租用IP，Pod注解中已经记录的租约或者同名Pod（StatefulSet）的租约继续使用
+// 新租用的IP不能被其他工作负载、FixedIPPool或者运行中的Pod使用
+func leaseFixedIP(pod *corev1.Pod, name string, dryRun bool) (FixedIP, error) {
+	var address FixedIP
+	leasedIP := ""
+	if pool, key, ok := parsePodLease(pod); ok && pool == name {
+		leasedIP = key
+	}
+	used, err := ipConflictChecker(ownerKey("FixedIPPool", pod.Namespace, name))
+	if err != nil {
+		return address, err
+	}
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pool, err := getFixedIPPool(pod.Namespace, name)
+		if err != nil {
+			return err
+		}
+		addresses, err := pool.addresses()
+		if err != nil {
+			return err
+		}
+		leased := make(map[string]FixedIPLease, len(pool.Status.Leases))
+		for _, lease := range pool.Status.Leases {
+			leased[lease.IP] = lease
+		}
+		for _, candidate := range addresses {
+			lease, ok := leased[candidate.IP]
+			if !ok {
+				continue
+			}
+			if (candidate.IP == leasedIP && (lease.Pod == "" || lease.Pod == pod.Name)) || (pod.Name != "" && lease.Pod == pod.Name) {
+				address = candidate
+				return nil
+			}
+		}
+		conflict := ""
+		for _, candidate := range addresses {
+			if _, ok := leased[candidate.IP]; ok {
+				continue
+			}
+			if usedBy, err := used(canonicalIP(candidate.IP)); err != nil {
+				return err
+			} else if usedBy != "" {
+				if conflict == "" {
+					conflict = fmt.Sprintf("FixedIPPool '%s': no free ip, ip %s is already used by %s", name, candidate.IP, usedBy)
+				}
+				continue
+			}
+			address = candidate
+			if dryRun {
+				return nil
+			}
+			pool.Status.Leases = append(pool.Status.Leases, FixedIPLease{IP: candidate.IP, Pod: pod.Name, Time: metav1.Now()})
+			return updateFixedIPPoolStatus(pool)
+		}
+		if conflict != "" {
+			return poolDenied(conflict)
+		}
+		return errPoolExhausted
+	})
+	return address, err
+}
+
+// 修改FixedIPPool中的租约，changed返回false时不修改，keep返回false时释放租约
+func updateFixedIPLease(namespace, name, ip string, update func(lease *ipLease) (keep, changed bool)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pool, err := getFixedIPPool(namespace, name)
+		if _, ok := err.(poolDenied); ok {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for i, lease := range pool.Status.Leases {
+			if lease.IP != ip {
+				continue
+			}
+			current := &ipLease{Pod: lease.Pod, Time: lease.Time.Time}
+			keep, changed := update(current)
+			if !changed {
+				return nil
+			}
+			if keep {
+				pool.Status.Leases[i].Pod, pool.Status.Leases[i].Time = current.Pod, metav1.NewTime(current.Time)
+			} else {
+				pool.Status.Leases = append(pool.Status.Leases[:i], pool.Status.Leases[i+1:]...)
+			}
+			return updateFixedIPPoolStatus(pool)
+		}
+		return nil
+	})
+}
+
+// 回收所有FixedIPPool中过期的租约，未安装CRD时跳过
+func gcFixedIPPools() {
+	client, err := DynamicClient()
+	if err != nil {
+		log.Errorf("fix-pod-ip: get dynamic client error: %v", err)
+		return
+	}
+	list, err := client.Resource(FixedIPPoolResource).List(context.TODO(), metav1.ListOptions{})
+	if errors.IsNotFound(err) {
+		return
+	} else if err != nil {
+		log.Errorf("fix-pod-ip: list FixedIPPools error: %v", err)
+		return
+	}
+	for i := range list.Items {
+		pool, err := toFixedIPPool(&list.Items[i])
+		if err != nil {
+			log.Errorf("fix-pod-ip: %v", err)
+			continue
+		}
+		for _, lease := range pool.Status.Leases {
+			current := &ipLease{Pod: lease.Pod, Time: lease.Time.Time}
+			if !leaseExpired(pool.Namespace, current) {
+				continue
+			}
+			err := updateFixedIPLease(pool.Namespace, pool.Name, lease.IP, func(lease *ipLease) (bool, bool) {
+				return false, leaseExpired(pool.Namespace, lease)
+			})
+			if err != nil {
+				log.Errorf("fix-pod-ip: gc FixedIPPool %s/%s lease %s error: %v", pool.Namespace, pool.Name, lease.IP, err)
+				continue
+			}
+			log.Infof("fix-pod-ip: gc FixedIPPool %s/%s lease %s of pod %s", pool.Namespace, pool.Name, lease.IP, lease.Pod)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package impl
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+func TestFixedIPPoolAddresses(t *testing.T) {
+	for _, c := range []struct {
+		spec  FixedIPPoolSpec
+		first string
+		count int
+		err   bool
+	}{
+		{spec: FixedIPPoolSpec{CIDR: "10.10.10.0/29"}, first: "10.10.10.1", count: 6},
+		{spec: FixedIPPoolSpec{CIDR: "10.10.10.8/31"}, first: "10.10.10.8", count: 2},
+		{spec: FixedIPPoolSpec{CIDR: "fd00::/126"}, first: "fd00::", count: 4},
+		{spec: FixedIPPoolSpec{IPs: []FixedIP{{IP: "10.10.10.1", Node: "node01"}}}, first: "10.10.10.1", count: 1},
+		{spec: FixedIPPoolSpec{CIDR: "10.0.0.0/8"}, err: true},
+		{spec: FixedIPPoolSpec{CIDR: "10.10.10.0/29", IPs: []FixedIP{{IP: "10.10.10.1"}}}, err: true},
+		{spec: FixedIPPoolSpec{IPs: []FixedIP{{IP: "10.10.10.1"}, {IP: "10.10.10.1"}}}, err: true},
+		{spec: FixedIPPoolSpec{IPs: []FixedIP{{IP: "10.10.10.256"}}}, err: true},
+	} {
+		pool := &FixedIPPool{ObjectMeta: metav1.ObjectMeta{Name: "db"}, Spec: c.spec}
+		addresses, err := pool.addresses()
+		if c.err {
+			if err == nil {
+				t.Errorf("%+v: expected error", c.spec)
+			}
+			continue
+		}
+		if err != nil || len(addresses) != c.count || addresses[0].IP != c.first {
+			t.Errorf("%+v: got %d addresses %v, want %d starting with %s", c.spec, len(addresses), err, c.count, c.first)
+		}
+	}
+}
+
+func fixedIPPoolObject(leases ...interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "preset.kingfisher.io/v1alpha1",
+		"kind":       "FixedIPPool",
+		"metadata":   map[string]interface{}{"name": "db", "namespace": "app"},
+		"spec":       map[string]interface{}{"cidr": "10.10.20.0/30"},
+		"status":     map[string]interface{}{"leases": leases},
+	}}
+}
+
+func TestLeaseFixedIP(t *testing.T) {
+	SetDynamicClient(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), fixedIPPoolObject()))
+	defer SetDynamicClient(nil)
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "app"}}
+	if address, err := leaseFixedIP(pod, "db", true); err != nil || address.IP != "10.10.20.1" {
+		t.Fatalf("dry run lease: got %+v %v", address, err)
+	}
+	for _, want := range []string{"10.10.20.1", "10.10.20.1"} {
+		// 同名Pod继续使用原来的IP
+		if address, err := leaseFixedIP(pod, "db", false); err != nil || address.IP != want {
+			t.Fatalf("lease: got %+v %v, want %s", address, err, want)
+		}
+	}
+	other := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "app", GenerateName: "db-"}}
+	if address, err := leaseFixedIP(other, "db", false); err != nil || address.IP != "10.10.20.2" {
+		t.Fatalf("lease: got %+v %v, want 10.10.20.2", address, err)
+	}
+	if _, err := leaseFixedIP(other, "db", false); err != errPoolExhausted {
+		t.Fatalf("lease from exhausted pool: got %v", err)
+	}
+	if _, err := leaseFixedIP(other, "cache", false); err == nil {
+		t.Fatal("lease from missing pool should fail")
+	} else if _, ok := err.(poolDenied); !ok {
+		t.Fatalf("missing pool should be denied, got %v", err)
+	}
+
+	other.Name = "db-7d9f8"
+	other.Annotations = map[string]string{FixPodIPPool: "db", FixPodIPLease: "db/10.10.20.2"}
+	bindPodLease(other)
+	pool, err := getFixedIPPool("app", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leases := pool.Status.Leases; len(leases) != 2 || leases[1].Pod != other.Name {
+		t.Errorf("lease not bound to pod: %+v", leases)
+	}
+	releasePodLease(other)
+	if pool, err = getFixedIPPool("app", "db"); err != nil || len(pool.Status.Leases) != 1 {
+		t.Errorf("lease not released: %+v %v", pool, err)
+	}
+}
+
+func TestGCFixedIPPools(t *testing.T) {
+	SetDynamicClient(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), fixedIPPoolObject(
+		map[string]interface{}{"ip": "10.10.20.1", "pod": "db-0", "time": time.Now().Format(time.RFC3339)},
+		map[string]interface{}{"ip": "10.10.20.2", "pod": "db-1", "time": time.Now().Format(time.RFC3339)},
+	)))
+	defer SetDynamicClient(nil)
+	client := fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "app"}})
+	defer func() { podLister = nil }()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	podLister = factory.Core().V1().Pods().Lister()
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+
+	gcFixedIPPools()
+	pool, err := getFixedIPPool("app", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leases := pool.Status.Leases; len(leases) != 1 || leases[0].Pod != "db-0" {
+		t.Errorf("leases after gc: %+v, want only db-0", leases)
+	}
+}
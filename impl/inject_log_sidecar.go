@@ -3,186 +3,137 @@ package impl
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/gin-gonic/gin"
-	"github.com/gin-gonic/gin/binding"
 	"github.com/open-kingfisher/king-utils/common/log"
-	"k8s.io/api/admission/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"net/http"
 	"strconv"
 )
 
-func MutateInjectLogSidecar(c *gin.Context) {
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if err := c.ShouldBindBodyWith(&ar, binding.JSON); err != nil {
-		log.Errorf("Can't unmarshal body to AdmissionReview: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
-		c.JSON(http.StatusInternalServerError, err)
-		return
-	} else {
-		// mutate handle
-		admissionResponse = MutateLog(&ar)
-		admissionReview := v1beta1.AdmissionReview{}
-		if admissionResponse != nil {
-			admissionReview.Response = admissionResponse
-			if ar.Request != nil {
-				admissionReview.Response.UID = ar.Request.UID
-			}
-		}
-		c.JSON(http.StatusOK, admissionReview)
-	}
+func init() {
+	Register(injectLogSidecar{})
 }
 
-func ValidateInjectLogSidecar(c *gin.Context) {
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if err := c.ShouldBindBodyWith(&ar, binding.JSON); err != nil {
-		log.Errorf("Can't unmarshal body to AdmissionReview: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
-		c.JSON(http.StatusInternalServerError, err)
-		return
-	} else {
-		// validate handle
-		admissionResponse = ValidateLog(&ar)
-		admissionReview := v1beta1.AdmissionReview{}
-		if admissionResponse != nil {
-			admissionReview.Response = admissionResponse
-			if ar.Request != nil {
-				admissionReview.Response.UID = ar.Request.UID
-			}
-		}
-		c.JSON(http.StatusOK, admissionReview)
+// LogSidecarConfig 日志sidecar的镜像以及未设置注解时的默认值
+type LogSidecarConfig struct {
+	Image                 string
+	PullPolicy            corev1.PullPolicy
+	DefaultMetricInterval string
+	DefaultLogDirectory   string
+}
+
+var logSidecar = LogSidecarConfig{
+	Image:                 "registry.wap.sina.cn/kingfisher/king-exporter:latest",
+	PullPolicy:            corev1.PullAlways,
+	DefaultMetricInterval: "60",
+	DefaultLogDirectory:   "/var/log",
+}
+
+// SetLogSidecarConfig 设置日志sidecar的配置，启动时根据配置文件调用，预设配置ConfigMap中的sidecar配置会覆盖此配置
+func SetLogSidecarConfig(config LogSidecarConfig) {
+	logSidecar = config
+}
+
+// 日志sidecar注入
+type injectLogSidecar struct{}
+
+func (injectLogSidecar) Name() string            { return "log-sidecar-inject" }
+func (injectLogSidecar) Path() string            { return "log" }
+func (injectLogSidecar) MutateKinds() []string   { return []string{"Pod"} }
+func (injectLogSidecar) ValidateKinds() []string { return []string{"Deployment", "StatefulSet"} }
+
+func (injectLogSidecar) Webhook() WebhookSpec {
+	return WebhookSpec{
+		Name: "log.sidecar.inject",
+		ObjectSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{InjectLogSidecarRequiredPodAnnotations: Enabled},
+		},
+		MutateOperations:   []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		ValidateOperations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update, admissionregistrationv1.Delete},
+		// validate会创建和删除ConfigMap，dryRun时跳过
+		ValidateSideEffects: admissionregistrationv1.SideEffectClassNoneOnDryRun,
 	}
 }
 
-func MutateLog(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
+func (injectLogSidecar) Mutate(req *admissionv1.AdmissionRequest) *Result {
+	return MutateLog(req)
+}
+
+func (injectLogSidecar) Validate(req *admissionv1.AdmissionRequest) *Result {
+	return ValidateLog(req)
+}
+
+func MutateLog(req *admissionv1.AdmissionRequest) *Result {
 	var (
 		originalLabels      map[string]string
 		originalAnnotations map[string]string
-		resourceName        string
-		patch               []patchOperation
 		pod                 corev1.Pod
 	)
 
-	log.Infof("Mutate: AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-		req.Kind, req.Namespace, req.Name, resourceName, req.UID, req.Operation, req.UserInfo)
-
-	switch req.Kind.Kind {
-	case "Pod":
-		if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
-			log.Errorf("Mutate: Can't unmarshal raw object to pod: %v", err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
-		}
-		log.Infof("Mutate: AdmissionReview Resource: %+v", pod)
-		resourceName, originalLabels, originalAnnotations = pod.Name, pod.Labels, pod.Annotations
-	default:
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
-		}
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		log.Errorf("Mutate: Can't unmarshal raw object to pod: %v", err)
+		return failed(err)
 	}
+	log.Infof("Mutate: AdmissionReview Resource: %+v", pod)
+	original := pod.DeepCopy()
+	originalLabels, originalAnnotations = original.Labels, original.Annotations
 
 	if v, ok := originalLabels[InjectLogSidecarRequiredPodAnnotations]; !ok {
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
-		}
+		return allowed()
 	} else {
 		if v == Enabled {
-			// volumes不一定存在
-			index := 0
-			if pod.Spec.Volumes != nil {
-				index = len(pod.Spec.Volumes)
-			}
+			config := CurrentPresetConfig()
+			sidecar := config.logSidecarConfig()
 			configMapName := GetDeploymentNameByPod(pod.GetGenerateName())
-			patch = append(patch, addLogConfigMapVolume(index, configMapName))
-			patch = append(patch, addLogFileDirectoryVolume(index+1))
+			addLogConfigMapVolume(&pod, configMapName)
+			addLogFileDirectoryVolume(&pod)
 
 			// 设置监控脚本执行周期
-			metricInterval := "60" // 默认60s
+			metricInterval := sidecar.DefaultMetricInterval
 			if interval, ok := originalAnnotations[MetricInterval]; ok {
 				metricInterval = interval
 			}
 			// 业务日志目录
-			logFileDirectory := "/var/log"
+			logFileDirectory := sidecar.DefaultLogDirectory
 			if directory, ok := originalAnnotations[LogFileDirectory]; ok {
 				logFileDirectory = directory
 			}
-			// container一定存在，添加日志容器
-			patch = append(patch, addLogContainer(len(pod.Spec.Containers), metricInterval, logFileDirectory))
 
 			// 业务容器添加日志目录
-			for indexContainer, container := range pod.Spec.Containers {
-				indexVolume := 0
-				if container.VolumeMounts != nil {
-					indexVolume = len(container.VolumeMounts)
-				}
-				patch = append(patch, addBusinessLogVolume(indexContainer, indexVolume, logFileDirectory))
+			for i := range pod.Spec.Containers {
+				addBusinessLogVolume(&pod.Spec.Containers[i], logFileDirectory)
 			}
+			// 添加日志容器
+			addLogContainer(&pod, sidecar, metricInterval, logFileDirectory)
 
 			// 添加prometheus注解
-			pPatch := addPrometheusAnnotation(configMapName)
-			patch = append(patch, pPatch...)
-
-		}
-	}
-
-	patchBytes, err := json.Marshal(patch)
-	if err != nil {
-		errorMassage := fmt.Sprintf("json.Marshal patch: '%s' error: %v", patch, err)
-		log.Errorf(errorMassage)
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: errorMassage,
-			},
+			addPrometheusAnnotation(&pod, configMapName, config.Sidecar.Annotations)
 		}
 	}
 
-	log.Infof("Mutate: AdmissionResponse: patch=%v\n", string(patchBytes))
-	// 当前仅支持patchType为JSONPatch的AdmissionResponse
-	return &v1beta1.AdmissionResponse{
-		Allowed: true,
-		Patch:   patchBytes,
-		PatchType: func() *v1beta1.PatchType { // 不用单独生成变量，直接命名函数返回
-			pt := v1beta1.PatchTypeJSONPatch
-			return &pt
-		}(),
-	}
+	return patchedDiff(original, &pod)
 }
 
-func ValidateLog(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
+func ValidateLog(req *admissionv1.AdmissionRequest) *Result {
 	var (
 		originalLabels         map[string]string
 		originalPodAnnotations map[string]string
 		resourceName           string
 	)
 
-	log.Infof("Validate: AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-		req.Kind, req.Namespace, req.Name, resourceName, req.UID, req.Operation, req.UserInfo)
+	// dryRun请求不能产生副作用，此时不创建和删除ConfigMap
+	dryRun := req.DryRun != nil && *req.DryRun
 
 	// 删除的时候也要删除ConfigMap
-	if req.Operation == v1beta1.Delete {
+	if req.Operation == admissionv1.Delete && !dryRun {
 		if err := DeleteConfigMap(req.Name, req.Namespace); err != nil {
 			log.Errorf("delete configMap error: name=%s, namespace:%s %v", req.Name, req.Namespace, err)
 		}
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
-		}
+	}
+	if req.Operation == admissionv1.Delete {
+		return allowed()
 	}
 
 	switch req.Kind.Kind {
@@ -190,11 +141,7 @@ func ValidateLog(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 		var dep appsv1.Deployment
 		if err := json.Unmarshal(req.Object.Raw, &dep); err != nil {
 			log.Errorf("Validate: Can't unmarshal raw object to Deployment: %v", err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+			return failed(err)
 		}
 		resourceName = dep.Name
 		originalLabels = dep.Labels
@@ -204,20 +151,12 @@ func ValidateLog(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 		var sts appsv1.StatefulSet
 		if err := json.Unmarshal(req.Object.Raw, &sts); err != nil {
 			log.Errorf("Validate: Can't unmarshal raw object to StatefulSet: %v", err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
+			return failed(err)
 		}
 		resourceName = sts.Name
 		originalLabels = sts.Labels
 		originalPodAnnotations = sts.Spec.Template.Annotations
 		log.Infof("Validate: StatefulSet for %v", sts)
-	default:
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
-		}
 	}
 
 	log.Info("original annotations: ", originalLabels)
@@ -227,40 +166,25 @@ func ValidateLog(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 		// log-injection不存在要删除ConfigMap
 		// 在用户去除log-injection标签进行提交的时候，还会过一下这个准入控制器，用于
 		// 删除ConfigMap，再次提交将不会过这个准入控制器
-		if err := DeleteConfigMap(resourceName, req.Namespace); err != nil {
-			log.Errorf("delete configMap error: name=%s, namespace:%s %v", resourceName, req.Namespace, err)
-		}
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
+		if !dryRun {
+			if err := DeleteConfigMap(resourceName, req.Namespace); err != nil {
+				log.Errorf("delete configMap error: name=%s, namespace:%s %v", resourceName, req.Namespace, err)
+			}
 		}
+		return allowed()
 	}
 	if value == Enabled {
 		if interval, ok := originalPodAnnotations[MetricInterval]; ok {
 			if _, err := strconv.Atoi(interval); err != nil {
-				return &v1beta1.AdmissionResponse{
-					Allowed: false,
-					Result: &metav1.Status{
-						Reason: metav1.StatusReason(fmt.Sprintf("Validate: Required '%s' are not integer", MetricInterval)),
-					},
-				}
+				return denied(fmt.Sprintf("Validate: Required '%s' are not integer", MetricInterval))
 			}
 		}
 		if directory, ok := originalPodAnnotations[LogFileDirectory]; !ok {
-			return &v1beta1.AdmissionResponse{
-				Allowed: false,
-				Result: &metav1.Status{
-					Reason: metav1.StatusReason(fmt.Sprintf("Validate: Required spec.template.annotation '%s' are not set", LogFileDirectory)),
-				},
-			}
+			return denied(fmt.Sprintf("Validate: Required spec.template.annotation '%s' are not set", LogFileDirectory))
 		} else if directory == "" {
-			return &v1beta1.AdmissionResponse{
-				Allowed: false,
-				Result: &metav1.Status{
-					Reason: metav1.StatusReason(fmt.Sprintf("Validate: Required spec.template.annotation '%s' are not empty", LogFileDirectory)),
-				},
-			}
+			return denied(fmt.Sprintf("Validate: Required spec.template.annotation '%s' are not empty", LogFileDirectory))
 		}
-		if err := GetConfigMap(resourceName, req.Namespace); err != nil { // configMap不存在的情况下创建对应configMap
+		if err := GetConfigMap(resourceName, req.Namespace); err != nil && !dryRun { // configMap不存在的情况下创建对应configMap
 			// 创建configMap
 			data := map[string]string{
 				LogMetricsShell: "#!/bin/sh\n#输出文件必须放到/tmp/目录下面并且以.prom结尾\necho 'qps{Business=\"example\",product=\"example_product\"} 90' > /tmp/example.prom",
@@ -268,16 +192,11 @@ func ValidateLog(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 			log.Info("stating create configMap")
 			if err := CreateConfigMap(resourceName, req.Namespace, data); err != nil {
 				log.Errorf("create configMap error: name=%s, namespace:%s %v", resourceName, req.Namespace, err)
-				return &v1beta1.AdmissionResponse{
-					Allowed: false,
-					Result: &metav1.Status{
-						Reason: metav1.StatusReason(fmt.Sprintf("Validate: Create ConfigMap '%s' is failure: '%s'", resourceName, err)),
-					},
-				}
+				return failed(fmt.Errorf("Validate: Create ConfigMap '%s' is failure: '%s'", resourceName, err))
 			}
 		}
 		// 删除的时候也要删除ConfigMap
-		if req.Operation == v1beta1.Delete {
+		if req.Operation == admissionv1.Delete && !dryRun {
 			if err := DeleteConfigMap(resourceName, req.Namespace); err != nil {
 				log.Errorf("delete configMap error: name=%s, namespace:%s %v", resourceName, req.Namespace, err)
 			}
@@ -286,15 +205,13 @@ func ValidateLog(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 		// log-injection值不为enabled也要删除ConfigMap
 		// 在用户去除log-injection标签进行提交的时候，还会过一下这个准入控制器，用于
 		// 删除ConfigMap，再次提交将不会过这个准入控制器
-		if err := DeleteConfigMap(resourceName, req.Namespace); err != nil {
-			log.Errorf("delete configMap error: name=%s, namespace:%s %v", resourceName, req.Namespace, err)
-		}
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
+		if !dryRun {
+			if err := DeleteConfigMap(resourceName, req.Namespace); err != nil {
+				log.Errorf("delete configMap error: name=%s, namespace:%s %v", resourceName, req.Namespace, err)
+			}
 		}
+		return allowed()
 	}
 
-	return &v1beta1.AdmissionResponse{
-		Allowed: true,
-	}
+	return allowed()
 }
@@ -0,0 +1,322 @@
+package impl
+
+import (
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"sort"
+	"strings"
+)
+
+// Pod按IP地址和MAC地址建立索引
+const (
+	podIPIndex  = "ip"
+	podMACIndex = "mac"
+)
+
+var (
+	statefulSetLister  appslisters.StatefulSetLister
+	deploymentLister   appslisters.DeploymentLister
+	replicaSetLister   appslisters.ReplicaSetLister
+	podIPIndexer       cache.Indexer
+	nodeLister         corelisters.NodeLister
+	fixedIPPoolLister  cache.GenericLister
+	calicoIPPoolLister cache.GenericLister
+)
+
+// 工作负载的标识，例如: StatefulSet app/web
+// Deployment创建的ReplicaSet和Pod都属于Deployment，不会和Deployment本身冲突
+func ownerKey(kind, namespace, name string) string {
+	return fmt.Sprintf("%s %s/%s", kind, namespace, name)
+}
+
+func workloadOwner(kind, namespace string, meta *metav1.ObjectMeta) string {
+	if owner := metav1.GetControllerOf(meta); kind == "ReplicaSet" && owner != nil && owner.Kind == "Deployment" {
+		return ownerKey(owner.Kind, namespace, owner.Name)
+	}
+	return ownerKey(kind, namespace, meta.Name)
+}
+
+// 从FixedIPPool租用IP的Pod属于IP池，同一个IP池的Pod先后使用同一个IP不算冲突
+func podOwner(pod *corev1.Pod) string {
+	if pool, ok := pod.Annotations[FixPodIPPool]; ok {
+		return ownerKey("FixedIPPool", pod.Namespace, pool)
+	}
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return ownerKey("Pod", pod.Namespace, pod.Name)
+	}
+	if owner.Kind == "ReplicaSet" {
+		if hash, ok := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; ok && strings.HasSuffix(owner.Name, "-"+hash) {
+			return ownerKey("Deployment", pod.Namespace, strings.TrimSuffix(owner.Name, "-"+hash))
+		}
+	}
+	return ownerKey(owner.Kind, pod.Namespace, owner.Name)
+}
+
+// Pod使用的IP，包括已经分配的IP和CNI插件注解中指定的IP，已经结束的Pod不再占用IP，IP转换为标准格式
+func podIPs(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return nil, nil
+	}
+	seen := make(map[string]bool)
+	for _, podIP := range pod.Status.PodIPs {
+		seen[canonicalIP(podIP.IP)] = true
+	}
+	if pod.Status.PodIP != "" {
+		seen[canonicalIP(pod.Status.PodIP)] = true
+	}
+	for _, ip := range cniBackend().PodIPs(pod) {
+		seen[canonicalIP(ip)] = true
+	}
+	ips := make([]string, 0, len(seen))
+	for ip := range seen {
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// Pod注解中指定的MAC地址，已经结束的Pod不再占用MAC地址
+func podMACs(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return nil, nil
+	}
+	if mac, err := canonicalMAC(cniBackend().PodMAC(pod)); err == nil {
+		return []string{mac}, nil
+	}
+	return nil, nil
+}
+
+// fix.pod.ip注解中所有的IP，转换为标准格式
+func annotationIPs(ip fixedIPs) []string {
+	var ips []string
+	for _, ordinal := range ip.ordinals() {
+		for _, entry := range ip[ordinal] {
+			for _, addr := range entry.IPs {
+				ips = append(ips, canonicalIP(addr))
+			}
+		}
+	}
+	return ips
+}
+
+// fix.pod.ip注解中所有的MAC地址，转换为标准格式
+func annotationMACs(ip fixedIPs) []string {
+	var macs []string
+	for _, ordinal := range ip.ordinals() {
+		for _, entry := range ip[ordinal] {
+			if mac, err := canonicalMAC(entry.MAC); err == nil {
+				macs = append(macs, mac)
+			}
+		}
+	}
+	return macs
+}
+
+// 开启了fix-pod-ip的工作负载以及其使用的地址，addresses从注解中取出IP或者MAC地址
+func fixedIPWorkloads(addresses func(fixedIPs) []string) (map[string][]string, error) {
+	workloads := make(map[string][]string)
+	add := func(kind string, meta *metav1.ObjectMeta, template *corev1.PodTemplateSpec) {
+		if v, ok := template.Annotations[RequiredPodAnnotations]; ok {
+			if ip, err := parseFixPodIP(v); err == nil {
+				owner := workloadOwner(kind, meta.Namespace, meta)
+				workloads[owner] = append(workloads[owner], addresses(ip)...)
+			}
+		}
+	}
+	statefulSets, err := statefulSetLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, sts := range statefulSets {
+		add("StatefulSet", &sts.ObjectMeta, &sts.Spec.Template)
+	}
+	deployments, err := deploymentLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, deployment := range deployments {
+		add("Deployment", &deployment.ObjectMeta, &deployment.Spec.Template)
+	}
+	replicaSets, err := replicaSetLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, replicaSet := range replicaSets {
+		add("ReplicaSet", &replicaSet.ObjectMeta, &replicaSet.Spec.Template)
+	}
+	return workloads, nil
+}
+
+// FixedIPPool以及其中所有的IP，IP转换为标准格式，未安装CRD时为空
+func fixedIPPoolAddresses() (map[string][]string, error) {
+	pools := make(map[string][]string)
+	if fixedIPPoolLister == nil {
+		return pools, nil
+	}
+	objs, err := fixedIPPoolLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objs {
+		pool, err := toFixedIPPool(obj)
+		if err != nil {
+			return nil, err
+		}
+		// 配置错误的IP池无法租用IP，不占用IP
+		addresses, err := pool.addresses()
+		if err != nil {
+			continue
+		}
+		owner := ownerKey("FixedIPPool", pool.Namespace, pool.Name)
+		for _, address := range addresses {
+			pools[owner] = append(pools[owner], canonicalIP(address.IP))
+		}
+	}
+	return pools, nil
+}
+
+// 检查IP是否已经被其他工作负载、FixedIPPool或者运行中的Pod使用，返回冲突的IP和使用此IP的资源
+// informer未启动时不检查
+func findIPConflict(owner string, ips []string) (string, string, error) {
+	used, err := ipConflictChecker(owner)
+	if err != nil {
+		return "", "", err
+	}
+	return findConflict(ips, used)
+}
+
+// 检查MAC地址是否已经被其他工作负载或者运行中的Pod使用
+func findMACConflict(owner string, macs []string) (string, string, error) {
+	if statefulSetLister == nil || podIPIndexer == nil {
+		return "", "", nil
+	}
+	workloads, err := fixedIPWorkloads(annotationMACs)
+	if err != nil {
+		return "", "", err
+	}
+	return findConflict(macs, conflictChecker(owner, workloads, podMACIndex))
+}
+
+func findConflict(values []string, used func(string) (string, error)) (string, string, error) {
+	for _, value := range values {
+		if usedBy, err := used(value); err != nil || usedBy != "" {
+			return value, usedBy, err
+		}
+	}
+	return "", "", nil
+}
+
+// 返回检查单个IP是否被owner以外的资源使用的函数，用于逐个检查大量IP，例如FixedIPPool中的候选IP
+func ipConflictChecker(owner string) (func(string) (string, error), error) {
+	if statefulSetLister == nil || podIPIndexer == nil {
+		return func(string) (string, error) { return "", nil }, nil
+	}
+	workloads, err := fixedIPWorkloads(annotationIPs)
+	if err != nil {
+		return nil, err
+	}
+	pools, err := fixedIPPoolAddresses()
+	if err != nil {
+		return nil, err
+	}
+	for pool, ips := range pools {
+		workloads[pool] = ips
+	}
+	return conflictChecker(owner, workloads, podIPIndex), nil
+}
+
+func conflictChecker(owner string, workloads map[string][]string, index string) func(string) (string, error) {
+	used := make(map[string]string)
+	others := make([]string, 0, len(workloads))
+	for other := range workloads {
+		others = append(others, other)
+	}
+	// 固定顺序，冲突时的提示信息保持一致
+	sort.Strings(others)
+	for _, other := range others {
+		if other == owner {
+			continue
+		}
+		for _, ip := range workloads[other] {
+			if _, ok := used[ip]; !ok {
+				used[ip] = other
+			}
+		}
+	}
+	return func(value string) (string, error) {
+		if other, ok := used[value]; ok {
+			return other, nil
+		}
+		pods, err := podIPIndexer.ByIndex(index, value)
+		if err != nil {
+			return "", err
+		}
+		for _, obj := range pods {
+			pod := obj.(*corev1.Pod)
+			other := podOwner(pod)
+			if other == owner {
+				continue
+			}
+			if usedBy := ownerKey("Pod", pod.Namespace, pod.Name); usedBy != other {
+				return usedBy + " of " + other, nil
+			}
+			return other, nil
+		}
+		return "", nil
+	}
+}
+
+// StartFixPodIPInformers 缓存开启了fix-pod-ip的工作负载、所有的Pod、节点、FixedIPPool和Calico IPPool
+// 用于检查IP冲突、节点是否存在以及IP是否在Calico IPPool中
+func StartFixPodIPInformers(stopCh <-chan struct{}) error {
+	client, err := K8SClient()
+	if err != nil {
+		return err
+	}
+	workloadFactory := informers.NewSharedInformerFactoryWithOptions(client, InformerResync,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labels.SelectorFromSet(labels.Set{FixPodIPLabel: Enabled}).String()
+		}),
+	)
+	statefulSets := workloadFactory.Apps().V1().StatefulSets()
+	deployments := workloadFactory.Apps().V1().Deployments()
+	replicaSets := workloadFactory.Apps().V1().ReplicaSets()
+	// 其他工作负载的Pod也可能占用IP，需要缓存所有的Pod
+	clusterFactory := informers.NewSharedInformerFactory(client, InformerResync)
+	pods := clusterFactory.Core().V1().Pods().Informer()
+	if err := pods.AddIndexers(cache.Indexers{podIPIndex: podIPs, podMACIndex: podMACs}); err != nil {
+		return err
+	}
+	nodes := clusterFactory.Core().V1().Nodes()
+	statefulSets.Informer()
+	deployments.Informer()
+	replicaSets.Informer()
+	nodes.Informer()
+	workloadFactory.Start(stopCh)
+	clusterFactory.Start(stopCh)
+	for _, factory := range []informers.SharedInformerFactory{workloadFactory, clusterFactory} {
+		for informerType, synced := range factory.WaitForCacheSync(stopCh) {
+			if !synced {
+				return fmt.Errorf("informer %v cache not synced", informerType)
+			}
+		}
+	}
+	listers, err := startDynamicInformers(stopCh, FixedIPPoolResource, CalicoIPPoolResource)
+	if err != nil {
+		return err
+	}
+	statefulSetLister, deploymentLister, replicaSetLister = statefulSets.Lister(), deployments.Lister(), replicaSets.Lister()
+	podIPIndexer = pods.GetIndexer()
+	nodeLister = nodes.Lister()
+	fixedIPPoolLister, calicoIPPoolLister = listers[FixedIPPoolResource], listers[CalicoIPPoolResource]
+	return nil
+}
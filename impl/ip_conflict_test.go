@@ -0,0 +1,91 @@
+package impl
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestFindIPConflict(t *testing.T) {
+	labels := map[string]string{FixPodIPLabel: Enabled}
+	template := corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{RequiredPodAnnotations: `[{"node01":["10.10.10.101"]}]`},
+	}}
+	controller := true
+	client := fake.NewSimpleClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "app", Labels: labels},
+			Spec:       appsv1.DeploymentSpec{Template: template},
+		},
+		// Deployment创建的ReplicaSet和Pod使用相同的IP
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "api-5d8f7c9b6", Namespace: "app", Labels: labels, OwnerReferences: []metav1.OwnerReference{
+				{APIVersion: "apps/v1", Kind: "Deployment", Name: "api", Controller: &controller},
+			}},
+			Spec: appsv1.ReplicaSetSpec{Template: template},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "api-5d8f7c9b6-x2x9k", Namespace: "app",
+				Annotations: map[string]string{CalicoHwAddr: "0a:58:0a:0a:0a:65"},
+				Labels:      map[string]string{appsv1.DefaultDeploymentUniqueLabelKey: "5d8f7c9b6"},
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "api-5d8f7c9b6", Controller: &controller},
+				},
+			},
+			Status: corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.10.10.101"},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "batch", Namespace: "app"},
+			Status:     corev1.PodStatus{Phase: corev1.PodSucceeded, PodIP: "10.10.10.102"},
+		},
+		// 不属于FixedIPPool的Pod使用了IP池中的IP
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: "app"},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.10.20.1"},
+		},
+	)
+	SetK8SClient(client)
+	defer SetK8SClient(nil)
+	SetDynamicClient(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), fixedIPPoolObject()))
+	defer SetDynamicClient(nil)
+	defer func() {
+		statefulSetLister, deploymentLister, replicaSetLister, podIPIndexer, nodeLister, fixedIPPoolLister, calicoIPPoolLister = nil, nil, nil, nil, nil, nil, nil
+	}()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := StartFixPodIPInformers(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		owner  string
+		ips    []string
+		usedBy string
+	}{
+		{owner: ownerKey("Deployment", "app", "api"), ips: []string{"10.10.10.101"}},
+		{owner: ownerKey("StatefulSet", "app", "web"), ips: []string{"10.10.10.101"}, usedBy: "Deployment app/api"},
+		// 已经结束的Pod不再占用IP
+		{owner: ownerKey("StatefulSet", "app", "web"), ips: []string{"10.10.10.102"}},
+		// FixedIPPool中的IP
+		{owner: ownerKey("StatefulSet", "app", "web"), ips: []string{"10.10.20.2"}, usedBy: "FixedIPPool app/db"},
+		{owner: ownerKey("FixedIPPool", "app", "db"), ips: []string{"10.10.10.101"}, usedBy: "Deployment app/api"},
+	} {
+		_, usedBy, err := findIPConflict(c.owner, c.ips)
+		if err != nil || usedBy != c.usedBy {
+			t.Errorf("%s %v: got %q %v, want %q", c.owner, c.ips, usedBy, err, c.usedBy)
+		}
+	}
+	if _, usedBy, err := findMACConflict(ownerKey("StatefulSet", "app", "web"), []string{"0a:58:0a:0a:0a:65"}); err != nil || usedBy != "Pod app/api-5d8f7c9b6-x2x9k of Deployment app/api" {
+		t.Errorf("mac conflict: got %q %v", usedBy, err)
+	}
+	// 跳过已经被其他Pod使用的IP
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "app", Annotations: map[string]string{FixPodIPPool: "db"}}}
+	if address, err := leaseFixedIP(pod, "db", true); err != nil || address.IP != "10.10.20.2" {
+		t.Errorf("lease fixed ip: got %+v %v, want 10.10.20.2", address, err)
+	}
+}
@@ -0,0 +1,340 @@
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common/log"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FixPodIPLabel       = "fix-pod-ip"
+	FixPodIPLease       = "fix.pod.ip.lease" // Pod注解，记录Pod租用的IP，格式: <pool>/<key>
+	FixPodIPPoolLabel   = "fix-pod-ip-pool"  // 租约ConfigMap的标签，值为IP池名称
+	LeasePendingTimeout = 5 * time.Minute    // 租用IP后Pod一直没有创建成功时释放租约
+	LeaseGCInterval     = time.Minute
+)
+
+// IP池中没有空闲的IP
+var errPoolExhausted = fmt.Errorf("no free ip in pool")
+
+// 租约，fix.pod.ip注解的IP池保存在ConfigMap中，key为fix.pod.ip中的序号
+// FixedIPPool保存在status中，key为IP地址
+type ipLease struct {
+	Pod  string    `json:"pod,omitempty"` // 为空表示Pod尚未创建完成，mutate时还没有Pod名称
+	Time time.Time `json:"time"`
+}
+
+// 租用IP之后创建的Pod，用于绑定和释放租约
+var podLister corelisters.PodLister
+
+// IP池的租约ConfigMap名称
+func leaseConfigMapName(pool string) string {
+	return pool + "-fix-pod-ip"
+}
+
+// Pod所属的IP池，Deployment创建的Pod使用Deployment名称，单独的ReplicaSet使用ReplicaSet名称
+// StatefulSet等其他资源创建的Pod不使用IP池
+func podPool(pod *corev1.Pod) (string, bool) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "ReplicaSet" {
+		return "", false
+	}
+	if hash, ok := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; ok {
+		return strings.TrimSuffix(owner.Name, "-"+hash), true
+	}
+	return owner.Name, true
+}
+
+// 解析Pod注解中的租约
+func parsePodLease(pod *corev1.Pod) (pool, key string, ok bool) {
+	value, ok := pod.Annotations[FixPodIPLease]
+	if !ok {
+		return "", "", false
+	}
+	i := strings.LastIndex(value, "/")
+	if i <= 0 || i == len(value)-1 {
+		return "", "", false
+	}
+	return value[:i], value[i+1:], true
+}
+
+// 从IP池中租用一个空闲的IP，返回fix.pod.ip中的序号，dryRun时只查找不保存租约
+func leaseIP(namespace, pool string, ordinals []int, dryRun bool) (int, error) {
+	client, err := K8SClient()
+	if err != nil {
+		return 0, err
+	}
+	configMaps := client.CoreV1().ConfigMaps(namespace)
+	name := leaseConfigMapName(pool)
+	index := -1
+	// 多个副本同时租用时通过resourceVersion冲突重试
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(context.TODO(), name, metav1.GetOptions{})
+		create := errors.IsNotFound(err)
+		if create {
+			configMap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: namespace,
+					Labels:    map[string]string{ManagedByLabel: KingPreset, FixPodIPPoolLabel: pool},
+				},
+			}
+		} else if err != nil {
+			return err
+		}
+		index = -1
+		for _, ordinal := range ordinals {
+			if _, ok := configMap.Data[strconv.Itoa(ordinal)]; !ok {
+				index = ordinal
+				break
+			}
+		}
+		if index < 0 {
+			return errPoolExhausted
+		}
+		if dryRun {
+			return nil
+		}
+		lease, err := json.Marshal(ipLease{Time: time.Now()})
+		if err != nil {
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[strconv.Itoa(index)] = string(lease)
+		if create {
+			_, err = configMaps.Create(context.TODO(), configMap, metav1.CreateOptions{})
+			if errors.IsAlreadyExists(err) {
+				return errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, name, err)
+			}
+			return err
+		}
+		_, err = configMaps.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+		return err
+	})
+	return index, err
+}
+
+// 修改ConfigMap中的租约，changed返回false时不修改，keep返回false时释放租约
+func updateLease(namespace, pool, key string, update func(lease *ipLease) (keep, changed bool)) error {
+	client, err := K8SClient()
+	if err != nil {
+		return err
+	}
+	configMaps := client.CoreV1().ConfigMaps(namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(context.TODO(), leaseConfigMapName(pool), metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		value, ok := configMap.Data[key]
+		if !ok {
+			return nil
+		}
+		lease := &ipLease{}
+		if err := json.Unmarshal([]byte(value), lease); err != nil {
+			log.Errorf("fix-pod-ip: invalid lease %s/%s[%s]: %v", namespace, configMap.Name, key, err)
+		}
+		keep, changed := update(lease)
+		if !changed {
+			return nil
+		}
+		if keep {
+			data, err := json.Marshal(lease)
+			if err != nil {
+				return err
+			}
+			configMap.Data[key] = string(data)
+		} else {
+			delete(configMap.Data, key)
+		}
+		_, err = configMaps.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// 修改Pod注解中记录的租约，使用FixedIPPool的Pod修改FixedIPPool的status
+func updatePodLease(pod *corev1.Pod, update func(lease *ipLease) (keep, changed bool)) (bool, error) {
+	pool, key, ok := parsePodLease(pod)
+	if !ok {
+		return false, nil
+	}
+	if _, ok := pod.Annotations[FixPodIPPool]; ok {
+		return true, updateFixedIPLease(pod.Namespace, pool, key, update)
+	}
+	return true, updateLease(pod.Namespace, pool, key, update)
+}
+
+// Pod创建成功后将租约绑定到Pod
+func bindPodLease(pod *corev1.Pod) {
+	if pod.DeletionTimestamp != nil {
+		return
+	}
+	_, err := updatePodLease(pod, func(lease *ipLease) (bool, bool) {
+		if lease.Pod != "" {
+			return true, false
+		}
+		lease.Pod = pod.Name
+		return true, true
+	})
+	if err != nil {
+		log.Errorf("fix-pod-ip: bind lease %s to pod %s/%s error: %v", pod.Annotations[FixPodIPLease], pod.Namespace, pod.Name, err)
+	}
+}
+
+// Pod删除后释放租约
+func releasePodLease(pod *corev1.Pod) {
+	// StatefulSet重建的Pod名称不变，保留租约继续使用原来的IP，Pod不再创建时由gcLeases回收
+	if owner := metav1.GetControllerOf(pod); owner != nil && owner.Kind == "StatefulSet" {
+		return
+	}
+	leased, err := updatePodLease(pod, func(lease *ipLease) (bool, bool) {
+		// 租约已经被其他Pod使用时不释放
+		if lease.Pod != "" && lease.Pod != pod.Name {
+			return true, false
+		}
+		return false, true
+	})
+	if !leased {
+		return
+	}
+	if err != nil {
+		log.Errorf("fix-pod-ip: release lease %s of pod %s/%s error: %v", pod.Annotations[FixPodIPLease], pod.Namespace, pod.Name, err)
+		return
+	}
+	log.Infof("fix-pod-ip: release lease %s of pod %s/%s", pod.Annotations[FixPodIPLease], pod.Namespace, pod.Name)
+}
+
+// 租约是否需要回收：Pod已经不存在，或者超时仍未绑定Pod
+func leaseExpired(namespace string, lease *ipLease) bool {
+	if lease.Pod == "" {
+		return time.Since(lease.Time) > LeasePendingTimeout
+	}
+	_, err := podLister.Pods(namespace).Get(lease.Pod)
+	return errors.IsNotFound(err)
+}
+
+// IP池对应的Deployment和ReplicaSet都已经删除，并且租约都已经释放时删除租约ConfigMap
+// 通过API Server确认工作负载不存在，去掉fix-pod-ip标签的工作负载不在informer缓存中
+func gcLeaseConfigMap(namespace, pool string) error {
+	client, err := K8SClient()
+	if err != nil {
+		return err
+	}
+	if _, err := client.AppsV1().Deployments(namespace).Get(context.TODO(), pool, metav1.GetOptions{}); !errors.IsNotFound(err) {
+		return err
+	}
+	if _, err := client.AppsV1().ReplicaSets(namespace).Get(context.TODO(), pool, metav1.GetOptions{}); !errors.IsNotFound(err) {
+		return err
+	}
+	configMaps := client.CoreV1().ConfigMaps(namespace)
+	configMap, err := configMaps.Get(context.TODO(), leaseConfigMapName(pool), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// 孤立的Pod仍然在使用IP时保留租约
+	if len(configMap.Data) != 0 {
+		return nil
+	}
+	// resourceVersion不变时才删除，避免删除同名工作负载刚刚写入的租约
+	err = configMaps.Delete(context.TODO(), configMap.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &configMap.ResourceVersion},
+	})
+	if errors.IsNotFound(err) || errors.IsConflict(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	log.Infof("fix-pod-ip: delete leases %s/%s of pool %s", namespace, configMap.Name, pool)
+	return nil
+}
+
+// 释放Pod已经不存在的租约，以及超时仍未绑定Pod的租约，删除工作负载已经不存在的租约ConfigMap
+func gcLeases() {
+	if configMapLister == nil || podLister == nil {
+		return
+	}
+	gcFixedIPPools()
+	selector := labels.SelectorFromSet(labels.Set{ManagedByLabel: KingPreset})
+	configMaps, err := configMapLister.List(selector)
+	if err != nil {
+		log.Errorf("fix-pod-ip: list lease configMaps error: %v", err)
+		return
+	}
+	for _, configMap := range configMaps {
+		pool, ok := configMap.Labels[FixPodIPPoolLabel]
+		if !ok {
+			continue
+		}
+		for key := range configMap.Data {
+			err := updateLease(configMap.Namespace, pool, key, func(lease *ipLease) (bool, bool) {
+				return false, leaseExpired(configMap.Namespace, lease)
+			})
+			if err != nil {
+				log.Errorf("fix-pod-ip: gc lease %s/%s[%s] error: %v", configMap.Namespace, configMap.Name, key, err)
+			}
+		}
+		if err := gcLeaseConfigMap(configMap.Namespace, pool); err != nil {
+			log.Errorf("fix-pod-ip: gc leases %s/%s error: %v", configMap.Namespace, configMap.Name, err)
+		}
+	}
+}
+
+// StartIPPoolController 监听开启了fix-pod-ip的Pod，绑定和释放IP池的租约，需要在StartInformers之后调用
+func StartIPPoolController(stopCh <-chan struct{}) error {
+	client, err := K8SClient()
+	if err != nil {
+		return err
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(client, InformerResync,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labels.SelectorFromSet(labels.Set{FixPodIPLabel: Enabled}).String()
+		}),
+	)
+	pods := factory.Core().V1().Pods()
+	pods.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			bindPodLease(obj.(*corev1.Pod))
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			bindPodLease(obj.(*corev1.Pod))
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*corev1.Pod); ok {
+				releasePodLease(pod)
+			}
+		},
+	})
+	factory.Start(stopCh)
+	for informerType, synced := range factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return fmt.Errorf("informer %v cache not synced", informerType)
+		}
+	}
+	podLister = pods.Lister()
+	go wait.Until(gcLeases, LeaseGCInterval, stopCh)
+	return nil
+}
@@ -0,0 +1,142 @@
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func leaseData(t *testing.T, client *fake.Clientset) map[string]string {
+	configMap, err := client.CoreV1().ConfigMaps("app").Get(context.TODO(), leaseConfigMapName("api"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configMap.Data
+}
+
+func TestLeaseIP(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	SetK8SClient(client)
+	defer SetK8SClient(nil)
+
+	if index, err := leaseIP("app", "api", []int{0, 1}, true); err != nil || index != 0 {
+		t.Fatalf("dry run lease: got %d %v, want 0", index, err)
+	}
+	for want := 0; want < 2; want++ {
+		if index, err := leaseIP("app", "api", []int{0, 1}, false); err != nil || index != want {
+			t.Fatalf("lease: got %d %v, want %d", index, err, want)
+		}
+	}
+	if _, err := leaseIP("app", "api", []int{0, 1}, false); err != errPoolExhausted {
+		t.Fatalf("lease from exhausted pool: got %v", err)
+	}
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "api-5d8f7c9b6-x2x9k",
+		Namespace:   "app",
+		Annotations: map[string]string{FixPodIPLease: "api/1"},
+	}}
+	bindPodLease(pod)
+	lease := ipLease{}
+	if err := json.Unmarshal([]byte(leaseData(t, client)["1"]), &lease); err != nil || lease.Pod != pod.Name {
+		t.Errorf("lease not bound to pod: %+v %v", lease, err)
+	}
+	// 租约被其他Pod使用时不释放
+	releasePodLease(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "app", Annotations: pod.Annotations}})
+	if _, ok := leaseData(t, client)["1"]; !ok {
+		t.Errorf("lease of another pod released")
+	}
+	releasePodLease(pod)
+	if _, ok := leaseData(t, client)["1"]; ok {
+		t.Errorf("lease not released")
+	}
+	if index, err := leaseIP("app", "api", []int{0, 1}, false); err != nil || index != 1 {
+		t.Errorf("lease released ip: got %d %v, want 1", index, err)
+	}
+}
+
+func TestGCLeases(t *testing.T) {
+	data := map[string]string{}
+	for i, lease := range []ipLease{
+		{Pod: "api-running", Time: time.Now()},
+		{Pod: "api-deleted", Time: time.Now()},
+		{Time: time.Now()},
+		{Time: time.Now().Add(-2 * LeasePendingTimeout)},
+	} {
+		value, _ := json.Marshal(lease)
+		data[strconv.Itoa(i)] = string(value)
+	}
+	client := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      leaseConfigMapName("api"),
+				Namespace: "app",
+				Labels:    map[string]string{ManagedByLabel: KingPreset, FixPodIPPoolLabel: "api"},
+			},
+			Data: data,
+		},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "api-running", Namespace: "app"}},
+	)
+	SetK8SClient(client)
+	defer SetK8SClient(nil)
+	SetDynamicClient(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()))
+	defer SetDynamicClient(nil)
+	defer func() { configMapLister, podLister = nil, nil }()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	configMapLister = factory.Core().V1().ConfigMaps().Lister()
+	podLister = factory.Core().V1().Pods().Lister()
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+
+	gcLeases()
+	got := leaseData(t, client)
+	for key, keep := range map[string]bool{"0": true, "1": false, "2": true, "3": false} {
+		if _, ok := got[key]; ok != keep {
+			t.Errorf("lease %s kept %v, want %v", key, ok, keep)
+		}
+	}
+}
+
+func TestGCLeaseConfigMap(t *testing.T) {
+	configMap := func(pool string, data map[string]string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      leaseConfigMapName(pool),
+				Namespace: "app",
+				Labels:    map[string]string{ManagedByLabel: KingPreset, FixPodIPPoolLabel: pool},
+			},
+			Data: data,
+		}
+	}
+	client := fake.NewSimpleClientset(
+		configMap("api", nil),
+		configMap("web", nil),
+		configMap("orphan", map[string]string{"0": `{"pod":"orphan-x2x9k"}`}),
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "app"}},
+	)
+	SetK8SClient(client)
+	defer SetK8SClient(nil)
+
+	// Deployment已经删除且没有租约时删除，工作负载仍然存在或者孤立的Pod仍然有租约时保留
+	for pool, deleted := range map[string]bool{"api": true, "web": false, "orphan": false} {
+		if err := gcLeaseConfigMap("app", pool); err != nil {
+			t.Fatalf("%s: %v", pool, err)
+		}
+		_, err := client.CoreV1().ConfigMaps("app").Get(context.TODO(), leaseConfigMapName(pool), metav1.GetOptions{})
+		if errors.IsNotFound(err) != deleted {
+			t.Errorf("%s: got error %v, want deleted %v", pool, err, deleted)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package impl
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	admissionv1 "k8s.io/api/admission/v1"
+	"time"
+)
+
+const (
+	MetricsNamespace = "king_preset"
+
+	VerdictAllow = "allow"
+	VerdictDeny  = "deny"
+	VerdictError = "error"
+)
+
+var (
+	// 各路由的请求数
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "requests_total",
+		Help:      "Number of admission requests handled, by preset, action, kind and namespace.",
+	}, []string{"preset", "action", "kind", "namespace"})
+	// 处理结果，verdict为allow、deny或error
+	verdicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "verdicts_total",
+		Help:      "Number of admission verdicts, by preset, action, kind, namespace and verdict (allow, deny, error).",
+	}, []string{"preset", "action", "kind", "namespace", "verdict"})
+	// 预设处理耗时
+	handleDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "handle_duration_seconds",
+		Help:      "Latency of admission handling, by preset, action, kind and namespace.",
+		Buckets:   []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	}, []string{"preset", "action", "kind", "namespace"})
+	// mutate生成的JSONPatch操作数，op为add、remove、replace等
+	patchOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "patch_operations_total",
+		Help:      "Number of JSON patch operations returned, by preset, kind, namespace and op.",
+	}, []string{"preset", "kind", "namespace", "op"})
+	// 请求体无法解析为AdmissionReview的请求数
+	malformedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "malformed_requests_total",
+		Help:      "Number of admission requests whose body could not be decoded into an AdmissionReview.",
+	}, []string{"preset", "action"})
+	// 预设内部错误数，policy为当时生效的失败策略
+	internalErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "internal_errors_total",
+		Help:      "Number of admission requests that hit an internal error, by the failure policy applied.",
+	}, []string{"preset", "action", "policy"})
+)
+
+func init() {
+	prometheus.MustRegister(requests, verdicts, handleDuration, patchOperations, malformedRequests, internalErrors)
+}
+
+// 记录一次准入请求的监控数据
+func observeAdmission(preset Preset, action string, req *admissionv1.AdmissionRequest, result *Result, start time.Time) {
+	kind, namespace := req.Kind.Kind, req.Namespace
+	requests.WithLabelValues(preset.Name(), action, kind, namespace).Inc()
+	handleDuration.WithLabelValues(preset.Name(), action, kind, namespace).Observe(time.Since(start).Seconds())
+
+	verdict := VerdictAllow
+	if result.Err != nil {
+		verdict = VerdictError
+	} else if !result.Allowed {
+		verdict = VerdictDeny
+	}
+	verdicts.WithLabelValues(preset.Name(), action, kind, namespace, verdict).Inc()
+
+	if verdict == VerdictAllow {
+		for _, patch := range result.Patch {
+			patchOperations.WithLabelValues(preset.Name(), kind, namespace, patch.Op).Inc()
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package impl
+
+import (
+	"encoding/json"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch"
+	jsondiff "gomodules.xyz/jsonpatch/v2"
+)
+
+// 是否在返回之前校验JSONPatch可以应用到原始资源
+var verifyPatches bool
+
+// SetVerifyPatches 开启后JSONPatch无法应用到原始资源时按内部错误处理
+func SetVerifyPatches(verify bool) {
+	verifyPatches = verify
+}
+
+// 对比修改前后的资源生成JSONPatch，预设只需要修改资源本身，不需要关心路径和下标
+// original为从请求中解析出的资源的副本，mutated为修改后的资源
+func createPatch(original, mutated interface{}) ([]patchOperation, error) {
+	originalJSON, err := json.Marshal(original)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal original object error: %v", err)
+	}
+	mutatedJSON, err := json.Marshal(mutated)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal mutated object error: %v", err)
+	}
+	operations, err := jsondiff.CreatePatch(originalJSON, mutatedJSON)
+	if err != nil {
+		return nil, fmt.Errorf("create patch error: %v", err)
+	}
+	patch := make([]patchOperation, 0, len(operations))
+	for _, operation := range operations {
+		patch = append(patch, patchOperation{
+			Op:    operation.Operation,
+			Path:  operation.Path,
+			Value: operation.Value,
+		})
+	}
+	return patch, nil
+}
+
+// 生成JSONPatch并放行，生成失败时按内部错误处理
+func patchedDiff(original, mutated interface{}) *Result {
+	patch, err := createPatch(original, mutated)
+	if err != nil {
+		return failed(err)
+	}
+	return patched(patch)
+}
+
+// 将JSONPatch应用到请求中的原始资源，检查是否可以被API Server正确应用
+func verifyPatch(patch []patchOperation, raw []byte) error {
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	decoded, err := jsonpatch.DecodePatch(patchBytes)
+	if err != nil {
+		return fmt.Errorf("decode patch error: %v", err)
+	}
+	if _, err := decoded.Apply(raw); err != nil {
+		return fmt.Errorf("patch does not apply to the original object: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package impl
+
+import (
+	"encoding/json"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"net/http"
+	"testing"
+)
+
+func TestCreatePatch(t *testing.T) {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "nginx"}}},
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := pod.DeepCopy()
+	// pod没有volumes和annotations
+	addLogConfigMapVolume(&pod, "web")
+	addLogFileDirectoryVolume(&pod)
+	addAnnotation(&pod, `["10.10.10.101"]`)
+	patch, err := createPatch(original, &pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyPatch(patch, raw); err != nil {
+		t.Errorf("patch %+v does not apply: %v", patch, err)
+	}
+	if len(patch) != 2 {
+		t.Errorf("expected 2 operations, got %+v", patch)
+	}
+}
+
+func TestVerifyPatch(t *testing.T) {
+	defer SetVerifyPatches(false)
+	preset := fixPodIP{}
+	raw := []byte(`{"metadata":{"name":"web-0"},"spec":{"containers":[{"name":"web"}]}}`)
+	req := &admissionv1.AdmissionRequest{
+		Kind:   metav1.GroupVersionKind{Kind: "Pod"},
+		Object: runtime.RawExtension{Raw: raw},
+	}
+	handle := func(*admissionv1.AdmissionRequest) *Result {
+		return patched([]patchOperation{{Op: "add", Path: "/spec/volumes/1", Value: map[string]string{"name": "log"}}})
+	}
+
+	if response := review(preset, MutateAction, preset.MutateKinds(), handle, req); !response.Allowed {
+		t.Errorf("without self-check: got %+v, want allowed", response)
+	}
+	SetVerifyPatches(true)
+	response := review(preset, MutateAction, preset.MutateKinds(), handle, req)
+	if response.Allowed || response.Result.Code != http.StatusInternalServerError {
+		t.Errorf("with self-check: got %+v, want denied as internal error", response)
+	}
+}
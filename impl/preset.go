@@ -0,0 +1,203 @@
+package impl
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-utils/common/log"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"time"
+)
+
+const (
+	MutateAction   = "mutate"
+	ValidateAction = "validate"
+)
+
+// Preset 预设功能，每个预设提供一组mutate和validate准入控制
+// 新增预设只需实现此接口并在init中调用Register注册
+type Preset interface {
+	// 预设名称，用于日志和监控，例如: fix-pod-ip
+	Name() string
+	// 路由路径，例如: fixpodip 对应 mutate/fixpodip 和 validate/fixpodip
+	Path() string
+	// mutate处理的资源类型，其他资源类型直接放行
+	MutateKinds() []string
+	// validate处理的资源类型，其他资源类型直接放行
+	ValidateKinds() []string
+	// Webhook配置，用于自动注册Mutating/ValidatingWebhookConfiguration
+	Webhook() WebhookSpec
+	Mutate(req *admissionv1.AdmissionRequest) *Result
+	Validate(req *admissionv1.AdmissionRequest) *Result
+}
+
+// Result 预设的处理结果，由框架统一转换为AdmissionResponse
+type Result struct {
+	Allowed bool
+	Message string           // 拒绝原因
+	Patch   []patchOperation // mutate生成的JSONPatch
+	Err     error            // 内部错误，例如反序列化失败
+}
+
+// 放行
+func allowed() *Result {
+	return &Result{Allowed: true}
+}
+
+// 放行并修改资源
+func patched(patch []patchOperation) *Result {
+	return &Result{Allowed: true, Patch: patch}
+}
+
+// 拒绝
+func denied(message string) *Result {
+	return &Result{Message: message}
+}
+
+// 内部错误
+func failed(err error) *Result {
+	return &Result{Message: err.Error(), Err: err}
+}
+
+var presets []Preset
+
+// Register 注册预设，名称和路径都不能重复
+func Register(preset Preset) {
+	for _, p := range presets {
+		if p.Name() == preset.Name() || p.Path() == preset.Path() {
+			panic(fmt.Sprintf("preset %s (%s) already registered", preset.Name(), preset.Path()))
+		}
+	}
+	presets = append(presets, preset)
+}
+
+// Presets 返回所有已注册的预设
+func Presets() []Preset {
+	return presets
+}
+
+// MutateHandler 生成预设mutate的gin handler
+func MutateHandler(preset Preset) gin.HandlerFunc {
+	return admissionHandler(preset, MutateAction, preset.MutateKinds(), preset.Mutate)
+}
+
+// ValidateHandler 生成预设validate的gin handler
+func ValidateHandler(preset Preset) gin.HandlerFunc {
+	return admissionHandler(preset, ValidateAction, preset.ValidateKinds(), preset.Validate)
+}
+
+func admissionHandler(preset Preset, action string, kinds []string, handle func(*admissionv1.AdmissionRequest) *Result) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ar, err := decodeAdmissionReview(c)
+		if err != nil {
+			log.Errorf("%s %s: Can't unmarshal body to AdmissionReview: %v", preset.Name(), action, err)
+			malformedRequests.WithLabelValues(preset.Name(), action).Inc()
+			writeMalformedReview(c, ar, err)
+			return
+		}
+		req := ar.Request
+		log.Infof("%s %s: AdmissionReview for Kind=%v, Namespace=%v Name=%v UID=%v Operation=%v UserInfo=%v",
+			preset.Name(), action, req.Kind, req.Namespace, req.Name, req.UID, req.Operation, req.UserInfo)
+		writeAdmissionReview(c, ar, review(preset, action, kinds, handle, req))
+	}
+}
+
+// Review 使用预设处理一个准入请求，与webhook的处理过程完全相同，用于离线评估
+func Review(preset Preset, action string, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if action == MutateAction {
+		return review(preset, action, preset.MutateKinds(), preset.Mutate, req)
+	}
+	return review(preset, action, preset.ValidateKinds(), preset.Validate, req)
+}
+
+func review(preset Preset, action string, kinds []string, handle func(*admissionv1.AdmissionRequest) *Result, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	start := time.Now()
+	result := allowed()
+	// 未启用的预设和被过滤的命名空间直接放行
+	config := CurrentPresetConfig()
+	if containsKind(kinds, req.Kind.Kind) && config.presetEnabled(preset.Name()) && config.namespaceAllowed(req.Namespace) {
+		result = safeHandle(handle, req)
+	}
+	// JSONPatch无法应用到原始资源时API Server会拒绝请求，提前按内部错误处理
+	if verifyPatches && result.Err == nil && len(result.Patch) != 0 {
+		if err := verifyPatch(result.Patch, req.Object.Raw); err != nil {
+			result = failed(err)
+		}
+	}
+	response := toAdmissionResponse(preset, action, result)
+	response.UID = req.UID
+	observeAdmission(preset, action, req, result, start)
+	return response
+}
+
+// 预设处理过程中的panic作为内部错误处理，避免gin recovery返回无法解析的500
+func safeHandle(handle func(*admissionv1.AdmissionRequest) *Result, req *admissionv1.AdmissionRequest) (result *Result) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = failed(fmt.Errorf("panic: %v", r))
+		}
+	}()
+	return handle(req)
+}
+
+// 将预设的处理结果转换为AdmissionResponse
+// 当前仅支持patchType为JSONPatch的AdmissionResponse
+func toAdmissionResponse(preset Preset, action string, result *Result) *admissionv1.AdmissionResponse {
+	if result.Err != nil {
+		// 内部错误按照预设的失败策略处理，并通过Warnings告知客户端
+		policy := FailurePolicy(preset.Name())
+		internalErrors.WithLabelValues(preset.Name(), action, policy).Inc()
+		log.Errorf("%s %s: internal error (%s): %v", preset.Name(), action, policy, result.Err)
+		if policy == FailOpen {
+			return &admissionv1.AdmissionResponse{
+				Allowed:  true,
+				Warnings: []string{fmt.Sprintf("king-preset %s: internal error ignored by failure policy %s: %s", preset.Name(), policy, result.Message)},
+			}
+		}
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Code:    http.StatusInternalServerError,
+				Message: result.Message,
+			},
+			Warnings: []string{fmt.Sprintf("king-preset %s: request denied by failure policy %s", preset.Name(), policy)},
+		}
+	}
+	if !result.Allowed {
+		log.Infof("%s %s: denied: %s", preset.Name(), action, result.Message)
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Code:    http.StatusForbidden,
+				Message: result.Message,
+			},
+		}
+	}
+	if len(result.Patch) == 0 {
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	patchBytes, err := json.Marshal(result.Patch)
+	if err != nil {
+		return toAdmissionResponse(preset, action, failed(fmt.Errorf("json.Marshal patch: '%+v' error: %s", result.Patch, err)))
+	}
+	log.Infof("%s %s: AdmissionResponse: patch=%v", preset.Name(), action, string(patchBytes))
+	return &admissionv1.AdmissionResponse{
+		Allowed: true,
+		Patch:   patchBytes,
+		PatchType: func() *admissionv1.PatchType {
+			pt := admissionv1.PatchTypeJSONPatch
+			return &pt
+		}(),
+	}
+}
+
+func containsKind(kinds []string, kind string) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package impl
+
+import (
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"sync/atomic"
+)
+
+// PresetConfigKey ConfigMap中保存预设配置的key
+const PresetConfigKey = "config.yaml"
+
+// PresetConfig 通过ConfigMap动态下发的预设配置，修改后无需重启即可生效
+type PresetConfig struct {
+	// 日志sidecar配置，未设置的字段使用启动参数中的配置
+	Sidecar SidecarOverride `json:"sidecar"`
+	// 启用的预设名称，为空时启用全部预设，未启用的预设直接放行
+	EnabledPresets []string `json:"enabledPresets"`
+	// 命名空间白名单和黑名单
+	Namespaces NamespaceFilter `json:"namespaces"`
+	// 固定IP的配置
+	FixPodIP FixPodIPOverride `json:"fixPodIP"`
+}
+
+// FixPodIPOverride 固定IP的集群默认配置，工作负载可以通过注解覆盖
+type FixPodIPOverride struct {
+	// Pod固定到节点的默认方式：nodeName、nodeAffinity、nodeSelector或none，为空时使用nodeName
+	NodePinning string `json:"nodePinning"`
+	// 为Pod指定IP的CNI插件：calico、multus、cilium或kube-ovn，为空时使用calico
+	CNI    string         `json:"cni"`
+	Multus MultusOverride `json:"multus"`
+	Cilium CiliumOverride `json:"cilium"`
+}
+
+// SidecarOverride 覆盖日志sidecar的启动配置
+type SidecarOverride struct {
+	Image                 string            `json:"image"`
+	PullPolicy            corev1.PullPolicy `json:"pullPolicy"`
+	DefaultMetricInterval string            `json:"defaultMetricInterval"`
+	DefaultLogDirectory   string            `json:"defaultLogDirectory"`
+	// 注入sidecar时为Pod添加的注解，会覆盖默认的prometheus注解，例如: prometheus.io/appmetricsport: "10900"
+	Annotations map[string]string `json:"annotations"`
+}
+
+// NamespaceFilter 命名空间过滤，Allow不为空时只处理Allow中的命名空间，Deny中的命名空间总是直接放行
+type NamespaceFilter struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+var (
+	presetConfig atomic.Value // *PresetConfig
+
+	// ConfigMap加载结果，result为success或failure
+	presetConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "preset_config_reloads_total",
+		Help:      "Number of preset config reloads from the ConfigMap, by result (success, failure).",
+	}, []string{"result"})
+)
+
+func init() {
+	presetConfig.Store(&PresetConfig{})
+	prometheus.MustRegister(presetConfigReloads)
+}
+
+// CurrentPresetConfig 返回当前生效的预设配置
+func CurrentPresetConfig() *PresetConfig {
+	return presetConfig.Load().(*PresetConfig)
+}
+
+// SetPresetConfig 直接设置预设配置，用于离线评估
+func SetPresetConfig(config *PresetConfig) {
+	presetConfig.Store(config)
+}
+
+// ParsePresetConfig 解析并校验预设配置
+func ParsePresetConfig(data string) (*PresetConfig, error) {
+	config := &PresetConfig{}
+	if err := yaml.UnmarshalStrict([]byte(data), config); err != nil {
+		return nil, err
+	}
+	for _, name := range config.EnabledPresets {
+		if !presetRegistered(name) {
+			return nil, fmt.Errorf("enabledPresets: preset '%s' is not registered", name)
+		}
+	}
+	switch config.Sidecar.PullPolicy {
+	case "", corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		return nil, fmt.Errorf("sidecar.pullPolicy '%s' is invalid, expected Always, IfNotPresent or Never", config.Sidecar.PullPolicy)
+	}
+	if interval := config.Sidecar.DefaultMetricInterval; interval != "" {
+		if i, err := strconv.Atoi(interval); err != nil || i <= 0 {
+			return nil, fmt.Errorf("sidecar.defaultMetricInterval '%s' is not a positive integer", interval)
+		}
+	}
+	if pinning := config.FixPodIP.NodePinning; pinning != "" && !CheckNodePinning(pinning) {
+		return nil, fmt.Errorf("fixPodIP.nodePinning '%s' is invalid, expected nodeName, nodeAffinity, nodeSelector or none", pinning)
+	}
+	if _, err := newCNIBackend(config.FixPodIP); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// 加载ConfigMap中的预设配置，配置不合法时继续使用原配置
+func applyPresetConfig(configMap *corev1.ConfigMap) {
+	config, err := ParsePresetConfig(configMap.Data[PresetConfigKey])
+	if err != nil {
+		presetConfigReloads.WithLabelValues("failure").Inc()
+		log.Errorf("Load preset config from configMap %s/%s error, keep the previous config: %v", configMap.Namespace, configMap.Name, err)
+		return
+	}
+	presetConfig.Store(config)
+	presetConfigReloads.WithLabelValues("success").Inc()
+	log.Infof("Load preset config from configMap %s/%s: %+v", configMap.Namespace, configMap.Name, *config)
+}
+
+// WatchPresetConfig 通过informer监听预设配置ConfigMap，ConfigMap删除后恢复为默认配置
+// 等待缓存同步并加载配置后返回，避免启动后处理请求时还没有加载enabledPresets和namespaces
+func WatchPresetConfig(client kubernetes.Interface, namespace, name string, stopCh <-chan struct{}) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+	configMaps := factory.Core().V1().ConfigMaps()
+	informer := configMaps.Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			applyPresetConfig(obj.(*corev1.ConfigMap))
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			applyPresetConfig(obj.(*corev1.ConfigMap))
+		},
+		DeleteFunc: func(obj interface{}) {
+			presetConfig.Store(&PresetConfig{})
+			log.Infof("Preset config configMap %s/%s deleted, use the default config", namespace, name)
+		},
+	})
+	factory.Start(stopCh)
+	for informerType, synced := range factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return fmt.Errorf("informer %v cache not synced", informerType)
+		}
+	}
+	// 事件处理函数异步执行，缓存同步后直接加载一次
+	if configMap, err := configMaps.Lister().ConfigMaps(namespace).Get(name); err == nil {
+		applyPresetConfig(configMap)
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// 预设是否启用
+func (c *PresetConfig) presetEnabled(name string) bool {
+	if len(c.EnabledPresets) == 0 {
+		return true
+	}
+	for _, p := range c.EnabledPresets {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 命名空间是否需要处理，集群级别的资源不过滤
+func (c *PresetConfig) namespaceAllowed(namespace string) bool {
+	if namespace == "" {
+		return true
+	}
+	for _, ns := range c.Namespaces.Deny {
+		if ns == namespace {
+			return false
+		}
+	}
+	if len(c.Namespaces.Allow) == 0 {
+		return true
+	}
+	for _, ns := range c.Namespaces.Allow {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// 合并启动配置和ConfigMap中的日志sidecar配置
+func (c *PresetConfig) logSidecarConfig() LogSidecarConfig {
+	config := logSidecar
+	if c.Sidecar.Image != "" {
+		config.Image = c.Sidecar.Image
+	}
+	if c.Sidecar.PullPolicy != "" {
+		config.PullPolicy = c.Sidecar.PullPolicy
+	}
+	if c.Sidecar.DefaultMetricInterval != "" {
+		config.DefaultMetricInterval = c.Sidecar.DefaultMetricInterval
+	}
+	if c.Sidecar.DefaultLogDirectory != "" {
+		config.DefaultLogDirectory = c.Sidecar.DefaultLogDirectory
+	}
+	return config
+}
@@ -0,0 +1,95 @@
+package impl
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+func TestParsePresetConfig(t *testing.T) {
+	config, err := ParsePresetConfig(`
+sidecar:
+  image: example/king-exporter:v1
+  annotations:
+    prometheus.io/appmetricsport: "9100"
+enabledPresets: [fix-pod-ip]
+namespaces:
+  allow: [app]
+  deny: [kube-system]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.presetEnabled("fix-pod-ip") || config.presetEnabled("log-sidecar-inject") {
+		t.Errorf("enabledPresets not applied: %+v", config.EnabledPresets)
+	}
+	if !config.namespaceAllowed("app") || config.namespaceAllowed("kube-system") || config.namespaceAllowed("other") {
+		t.Errorf("namespace filter not applied: %+v", config.Namespaces)
+	}
+	if sidecar := config.logSidecarConfig(); sidecar.Image != "example/king-exporter:v1" || sidecar.DefaultLogDirectory != logSidecar.DefaultLogDirectory {
+		t.Errorf("sidecar config not merged: %+v", sidecar)
+	}
+
+	for _, data := range []string{
+		"enabledPresets: [unknown]",
+		"sidecar:\n  pullPolicy: Sometimes",
+		"sidecar:\n  defaultMetricInterval: abc",
+		"fixPodIP:\n  nodePinning: hostName",
+		"fixPodIP:\n  cni: flannel",
+		"unknownField: true",
+	} {
+		if _, err := ParsePresetConfig(data); err == nil {
+			t.Errorf("ParsePresetConfig(%q) expected error", data)
+		}
+	}
+}
+
+func TestWatchPresetConfig(t *testing.T) {
+	defer presetConfig.Store(&PresetConfig{})
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "king-preset-config", Namespace: "kingfisher-system"},
+		Data:       map[string]string{PresetConfigKey: "enabledPresets: [fix-pod-ip]"},
+	}
+	client := fake.NewSimpleClientset(configMap)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := WatchPresetConfig(client, configMap.Namespace, configMap.Name, stopCh); err != nil {
+		t.Fatal(err)
+	}
+	// 返回时已经加载了配置
+	if CurrentPresetConfig().presetEnabled("log-sidecar-inject") {
+		t.Fatal("preset config not loaded before WatchPresetConfig returns")
+	}
+
+	waitFor := func(condition func(*PresetConfig) bool) bool {
+		return wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			return condition(CurrentPresetConfig()), nil
+		}) == nil
+	}
+
+	// 不合法的配置不生效
+	configMap.Data[PresetConfigKey] = "enabledPresets: [unknown]"
+	if _, err := client.CoreV1().ConfigMaps(configMap.Namespace).Update(context.TODO(), configMap, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	configMap.Data[PresetConfigKey] = "namespaces:\n  deny: [kube-system]"
+	if _, err := client.CoreV1().ConfigMaps(configMap.Namespace).Update(context.TODO(), configMap, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func(c *PresetConfig) bool {
+		return !c.namespaceAllowed("kube-system") && c.presetEnabled("log-sidecar-inject")
+	}) {
+		t.Fatal("preset config not updated")
+	}
+
+	if err := client.CoreV1().ConfigMaps(configMap.Namespace).Delete(context.TODO(), configMap.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func(c *PresetConfig) bool { return c.namespaceAllowed("kube-system") }) {
+		t.Fatal("preset config not reset after configMap deleted")
+	}
+}
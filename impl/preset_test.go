@@ -0,0 +1,80 @@
+package impl
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFailurePolicy(t *testing.T) {
+	defer SetFailurePolicies("")
+	preset := fixPodIP{}
+	result := failed(errors.New("json.Marshal error"))
+
+	if err := SetFailurePolicies(""); err != nil {
+		t.Fatal(err)
+	}
+	response := toAdmissionResponse(preset, MutateAction, result)
+	if response.Allowed || response.Result.Code != http.StatusInternalServerError || len(response.Warnings) != 1 {
+		t.Errorf("fail-closed: got %+v, want denied with a warning", response)
+	}
+
+	if err := SetFailurePolicies(preset.Name() + "=" + FailOpen); err != nil {
+		t.Fatal(err)
+	}
+	response = toAdmissionResponse(preset, MutateAction, result)
+	if !response.Allowed || len(response.Warnings) != 1 {
+		t.Errorf("fail-open: got %+v, want allowed with a warning", response)
+	}
+
+	for _, value := range []string{"fix-pod-ip", "unknown=fail-open", "fix-pod-ip=ignore"} {
+		if err := SetFailurePolicies(value); err == nil {
+			t.Errorf("SetFailurePolicies(%q) expected error", value)
+		}
+	}
+}
+
+func TestPanicIsInternalError(t *testing.T) {
+	result := safeHandle(func(*admissionv1.AdmissionRequest) *Result {
+		var ip []string
+		_ = ip[1]
+		return allowed()
+	}, &admissionv1.AdmissionRequest{})
+	if result.Err == nil {
+		t.Errorf("panic should be reported as internal error, got %+v", result)
+	}
+}
+
+func TestObserveAdmission(t *testing.T) {
+	preset := fixPodIP{}
+	req := &admissionv1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Kind: "Pod"},
+		Namespace: "observe",
+	}
+	// 指标是进程内全局的，检查调用前后的差值，go test -count=N时同样适用
+	requestsCounter := requests.WithLabelValues(preset.Name(), MutateAction, "Pod", "observe")
+	allowCounter := verdicts.WithLabelValues(preset.Name(), MutateAction, "Pod", "observe", VerdictAllow)
+	denyCounter := verdicts.WithLabelValues(preset.Name(), MutateAction, "Pod", "observe", VerdictDeny)
+	patchCounter := patchOperations.WithLabelValues(preset.Name(), "Pod", "observe", "add")
+	requestsBefore, allowBefore, denyBefore, patchBefore := testutil.ToFloat64(requestsCounter), testutil.ToFloat64(allowCounter), testutil.ToFloat64(denyCounter), testutil.ToFloat64(patchCounter)
+
+	observeAdmission(preset, MutateAction, req, patched([]patchOperation{{Op: "add", Path: "/spec/nodeName", Value: "node01"}}), time.Now())
+	observeAdmission(preset, MutateAction, req, denied("denied"), time.Now())
+
+	if v := testutil.ToFloat64(requestsCounter) - requestsBefore; v != 2 {
+		t.Errorf("requests %v, want 2", v)
+	}
+	if v := testutil.ToFloat64(allowCounter) - allowBefore; v != 1 {
+		t.Errorf("verdict %s %v, want 1", VerdictAllow, v)
+	}
+	if v := testutil.ToFloat64(denyCounter) - denyBefore; v != 1 {
+		t.Errorf("verdict %s %v, want 1", VerdictDeny, v)
+	}
+	if v := testutil.ToFloat64(patchCounter) - patchBefore; v != 1 {
+		t.Errorf("patch operations %v, want 1", v)
+	}
+}
@@ -1,17 +1,41 @@
 package impl
 
 import (
+	"context"
 	"github.com/open-kingfisher/king-utils/common/log"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 )
 
+const (
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	KingPreset     = "king-preset"
+)
+
+// king-preset创建的ConfigMap缓存，StartInformers之后可用
+var configMapLister corelisters.ConfigMapLister
+
+func managedByKingPreset(options *metav1.ListOptions) {
+	options.LabelSelector = labels.SelectorFromSet(labels.Set{ManagedByLabel: KingPreset}).String()
+}
+
 func GetConfigMap(name, namespace string) error {
+	if configMapLister != nil {
+		if _, err := configMapLister.ConfigMaps(namespace).Get(name); err != nil {
+			log.Errorf("get configMap: %s namespace: %s from cache error: %v", name, namespace, err)
+			return err
+		}
+		return nil
+	}
 	if clientSet, err := K8SClient(); err != nil {
 		log.Errorf("get clientSet error: %v", err)
 		return err
 	} else {
-		if _, err := clientSet.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{}); err != nil {
+		if _, err := clientSet.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{}); err != nil {
 			log.Errorf("get configMap: %s namespace: %s error: %v", name, namespace, err)
 			return err
 		}
@@ -28,10 +52,15 @@ func CreateConfigMap(name, namespace string, data map[string]string) error {
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      name,
 				Namespace: namespace,
+				Labels:    map[string]string{ManagedByLabel: KingPreset},
 			},
 			Data: data,
 		}
-		if _, err := clientSet.CoreV1().ConfigMaps(namespace).Create(configMap); err != nil {
+		_, err := clientSet.CoreV1().ConfigMaps(namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			// 缓存尚未同步或者是旧版本创建的没有标签的ConfigMap，补充标签后纳入缓存
+			return adoptConfigMap(clientSet.CoreV1().ConfigMaps(namespace), name)
+		} else if err != nil {
 			log.Errorf("create configMap: %s namespace: %s error: %v", name, namespace, err)
 			return err
 		}
@@ -40,14 +69,50 @@ func CreateConfigMap(name, namespace string, data map[string]string) error {
 }
 
 func DeleteConfigMap(name, namespace string) error {
-	if clientSet, err := K8SClient(); err != nil {
+	clientSet, err := K8SClient()
+	if err != nil {
 		log.Errorf("get clientSet error: %v", err)
 		return err
-	} else {
-		if err := clientSet.CoreV1().ConfigMaps(namespace).Delete(name, &metav1.DeleteOptions{}); err != nil {
-			log.Errorf("delete configMap: %s namespace: %s error: %v", name, namespace, err)
-			return err
+	}
+	configMaps := clientSet.CoreV1().ConfigMaps(namespace)
+	if configMapLister != nil {
+		if _, err := configMapLister.ConfigMaps(namespace).Get(name); errors.IsNotFound(err) {
+			// 缓存可能尚未同步刚创建的ConfigMap，直接查询API Server，只删除king-preset创建的ConfigMap
+			configMap, err := configMaps.Get(context.TODO(), name, metav1.GetOptions{})
+			if errors.IsNotFound(err) {
+				return nil
+			} else if err != nil {
+				log.Errorf("get configMap: %s namespace: %s error: %v", name, namespace, err)
+				return err
+			}
+			if configMap.Labels[ManagedByLabel] != KingPreset {
+				return nil
+			}
 		}
 	}
+	if err := configMaps.Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil {
+		log.Errorf("delete configMap: %s namespace: %s error: %v", name, namespace, err)
+		return err
+	}
+	return nil
+}
+
+// 为已存在的ConfigMap添加managed-by标签
+func adoptConfigMap(client typedcorev1.ConfigMapInterface, name string) error {
+	configMap, err := client.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if configMap.Labels[ManagedByLabel] == KingPreset {
+		return nil
+	}
+	if configMap.Labels == nil {
+		configMap.Labels = map[string]string{}
+	}
+	configMap.Labels[ManagedByLabel] = KingPreset
+	if _, err := client.Update(context.TODO(), configMap, metav1.UpdateOptions{}); err != nil {
+		log.Errorf("adopt configMap: %s namespace: %s error: %v", name, configMap.Namespace, err)
+		return err
+	}
 	return nil
 }
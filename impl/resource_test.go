@@ -0,0 +1,81 @@
+package impl
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+	"time"
+)
+
+func TestConfigMapCache(t *testing.T) {
+	// 旧版本创建的ConfigMap没有managed-by标签，other不是king-preset创建的ConfigMap
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: "app"},
+	}, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "app"},
+	})
+	SetK8SClient(client)
+	defer SetK8SClient(nil)
+	defer func() { configMapLister = nil }()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := StartInformers(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GetConfigMap("legacy", "app"); !errors.IsNotFound(err) {
+		t.Errorf("unlabeled configMap should not be cached, got %v", err)
+	}
+	if err := CreateConfigMap("legacy", "app", nil); err != nil {
+		t.Fatalf("adopt legacy configMap: %v", err)
+	}
+	if err := CreateConfigMap("web", "app", map[string]string{LogMetricsShell: "#!/bin/sh"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"legacy", "web"} {
+		name := name
+		if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			return GetConfigMap(name, "app") == nil, nil
+		}); err != nil {
+			t.Errorf("configMap %s not in cache", name)
+		}
+	}
+
+	// 缓存中不存在时查询API Server，只删除带有managed-by标签的ConfigMap
+	if err := DeleteConfigMap("missing", "app"); err != nil {
+		t.Errorf("delete missing configMap: %v", err)
+	}
+	if err := DeleteConfigMap("other", "app"); err != nil {
+		t.Errorf("delete unlabeled configMap: %v", err)
+	}
+	if _, err := client.CoreV1().ConfigMaps("app").Get(context.TODO(), "other", metav1.GetOptions{}); err != nil {
+		t.Errorf("unlabeled configMap other should not be deleted: %v", err)
+	}
+	// 刚创建、尚未同步到缓存的ConfigMap，使用空的缓存模拟
+	if _, err := client.CoreV1().ConfigMaps("app").Create(context.TODO(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "uncached", Namespace: "app", Labels: map[string]string{ManagedByLabel: KingPreset}},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	lister := configMapLister
+	configMapLister = corelisters.NewConfigMapLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+	if err := DeleteConfigMap("uncached", "app"); err != nil {
+		t.Fatal(err)
+	}
+	configMapLister = lister
+	if _, err := client.CoreV1().ConfigMaps("app").Get(context.TODO(), "uncached", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("configMap uncached not deleted: %v", err)
+	}
+	if err := DeleteConfigMap("web", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreV1().ConfigMaps("app").Get(context.TODO(), "web", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("configMap web not deleted: %v", err)
+	}
+}
@@ -3,13 +3,16 @@ package impl
 import (
 	"fmt"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
 const (
-	CalicoIPAddr                      = "cni.projectcalico.org~1ipAddrs" // cni.projectcalico.org/ipAddrs /为特殊字符在jsonPatch中要修改为~1
+	CalicoIPAddr                      = "cni.projectcalico.org/ipAddrs"
 	RequiredPodAnnotations            = "fix.pod.ip"
 	EndpointExternalIPEnableLabels    = "endpoint-external-ip"
 	RequiredServiceExternalIPLabels   = "externalIP"
@@ -29,13 +32,31 @@ const (
 	LogFileDirectory   = "log-file-directory"
 	LogScriptDirectory = "log-script-directory"
 
-	PrometheusAPPInfoName    = "prometheus.io~1appinfoname"
-	PrometheusAPPMetrics     = "prometheus.io~1appmetrics"
-	PrometheusAPPMetricsPath = "prometheus.io~1appmetricspath"
-	PrometheusAPPMetricsPort = "prometheus.io~1appmetricsport"
-	PrometheusScrape         = "prometheus.io~1scrape"
+	PrometheusAPPInfoName    = "prometheus.io/appinfoname"
+	PrometheusAPPMetrics     = "prometheus.io/appmetrics"
+	PrometheusAPPMetricsPath = "prometheus.io/appmetricspath"
+	PrometheusAPPMetricsPort = "prometheus.io/appmetricsport"
+	PrometheusScrape         = "prometheus.io/scrape"
 )
 
+// Pod固定到节点的方式，通过fix.pod.ip.node-pinning注解指定
+const (
+	FixPodIPNodePinning     = "fix.pod.ip.node-pinning"
+	NodePinningNodeName     = "nodeName"     // 直接设置spec.nodeName，不经过调度器，默认方式
+	NodePinningNodeAffinity = "nodeAffinity" // 添加必须满足的节点亲和性，由调度器检查污点和资源
+	NodePinningNodeSelector = "nodeSelector" // 添加kubernetes.io/hostname节点选择器，节点的hostname标签需要和节点名称一致
+	NodePinningNone         = "none"         // 不固定节点，用于IP可以在节点之间漂移的CNI
+)
+
+// 检查Pod固定到节点的方式是否合法
+func CheckNodePinning(pinning string) bool {
+	switch pinning {
+	case NodePinningNodeName, NodePinningNodeAffinity, NodePinningNodeSelector, NodePinningNone:
+		return true
+	}
+	return false
+}
+
 type patchOperation struct {
 	Op    string      `json:"op"`
 	Path  string      `json:"path"`
@@ -43,60 +64,89 @@ type patchOperation struct {
 }
 
 // 为Pod指定特定的Node
-func mutateNodeName(nodeName string) (patch []patchOperation) {
-	return append(patch, patchOperation{
-		Op:    "add",
-		Path:  "/spec/nodeName",
-		Value: nodeName,
-	})
+func mutateNodeName(pod *corev1.Pod, nodeName string) {
+	pod.Spec.NodeName = nodeName
 }
 
-// 为Pod添加注解使用calico 'cni.projectcalico.org/ipAddrs' 这个特性
-func addAnnotation(ipAddr string) (patch []patchOperation) {
-	return append(patch, patchOperation{
-		Op:    "add",
-		Path:  "/metadata/annotations/" + CalicoIPAddr,
-		Value: ipAddr,
-	})
+// 将Pod固定到节点，pinning为Pod固定到节点的方式
+func pinPodToNode(pod *corev1.Pod, nodeName, pinning string) {
+	switch pinning {
+	case NodePinningNodeAffinity:
+		addNodeAffinity(pod, nodeName)
+	case NodePinningNodeSelector:
+		if pod.Spec.NodeSelector == nil {
+			pod.Spec.NodeSelector = map[string]string{}
+		}
+		pod.Spec.NodeSelector[corev1.LabelHostname] = nodeName
+	case NodePinningNone:
+	default:
+		mutateNodeName(pod, nodeName)
+	}
 }
 
-// 为endpoint添加ip
-func addSubset(subset corev1.EndpointSubset, index int) (patch patchOperation) {
-	if index == 0 {
-		return patchOperation{
-			Op:   "add",
-			Path: "/subsets",
-			Value: []corev1.EndpointSubset{
-				subset,
-			},
+// 添加必须满足的节点亲和性，Pod已有的每个nodeSelectorTerm都需要添加，否则多个term之间是或的关系
+func addNodeAffinity(pod *corev1.Pod, nodeName string) {
+	requirement := corev1.NodeSelectorRequirement{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{nodeName}}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &corev1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	nodeAffinity := pod.Spec.Affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	required := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(required.NodeSelectorTerms) == 0 {
+		required.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+	for i := range required.NodeSelectorTerms {
+		term := &required.NodeSelectorTerms[i]
+		exists := false
+		for _, field := range term.MatchFields {
+			if reflect.DeepEqual(field, requirement) {
+				exists = true
+			}
 		}
-	} else {
-		return patchOperation{
-			Op:    "add",
-			Path:  fmt.Sprintf("/subsets/%d", index),
-			Value: subset,
+		// Pod模板中可能已经有相同的亲和性，不重复添加
+		if !exists {
+			term.MatchFields = append(term.MatchFields, requirement)
 		}
 	}
 }
 
+// 为Pod添加注解使用calico 'cni.projectcalico.org/ipAddrs' 这个特性
+func addAnnotation(pod *corev1.Pod, ipAddr string) {
+	setAnnotation(&pod.ObjectMeta, CalicoIPAddr, ipAddr)
+}
+
+// 设置注解，annotations不一定存在
+func setAnnotation(meta *metav1.ObjectMeta, key, value string) {
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[key] = value
+}
+
+// 为endpoint添加ip
+func addSubset(endpoint *corev1.Endpoints, subset corev1.EndpointSubset) {
+	endpoint.Subsets = append(endpoint.Subsets, subset)
+}
+
 // 业务容器添加挂载共享目录的卷
-func addBusinessLogVolume(indexContainer, indexVolume int, logFileDirectory string) (patch patchOperation) {
-	volume := corev1.VolumeMount{
+func addBusinessLogVolume(container *corev1.Container, logFileDirectory string) {
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
 		Name:      LogFileDirectory,
 		MountPath: logFileDirectory,
-	}
-	return patchOperation{
-		Op:    "add",
-		Path:  fmt.Sprintf("/spec/containers/%d/volumeMounts/%d", indexContainer, indexVolume),
-		Value: volume,
-	}
+	})
 }
 
 // 为Containers添加log container
-func addLogContainer(index int, metricInterval, logFileDirectory string) (patch patchOperation) {
-	container := corev1.Container{
+func addLogContainer(pod *corev1.Pod, sidecar LogSidecarConfig, metricInterval, logFileDirectory string) {
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
 		Name:  "king-exporter",
-		Image: "registry.wap.sina.cn/kingfisher/king-exporter:latest",
+		Image: sidecar.Image,
 		VolumeMounts: []corev1.VolumeMount{
 			{
 				Name:      LogScriptDirectory,
@@ -114,18 +164,13 @@ func addLogContainer(index int, metricInterval, logFileDirectory string) (patch
 				Value: metricInterval,
 			},
 		},
-		ImagePullPolicy: corev1.PullAlways,
-	}
-	return patchOperation{
-		Op:    "add",
-		Path:  fmt.Sprintf("/spec/containers/%d", index),
-		Value: container,
-	}
+		ImagePullPolicy: sidecar.PullPolicy,
+	})
 }
 
 // 为Volumes添加configMap
-func addLogConfigMapVolume(index int, configMapName string) (patch patchOperation) {
-	volume := corev1.Volume{
+func addLogConfigMapVolume(pod *corev1.Pod, configMapName string) {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
 		Name: LogScriptDirectory,
 		VolumeSource: corev1.VolumeSource{
 			ConfigMap: &corev1.ConfigMapVolumeSource{
@@ -138,49 +183,23 @@ func addLogConfigMapVolume(index int, configMapName string) (patch patchOperatio
 				}(),
 			},
 		},
-	}
-	if index == 0 {
-		return patchOperation{
-			Op:    "add",
-			Path:  "/volumes",
-			Value: volume,
-		}
-	} else {
-		return patchOperation{
-			Op:    "add",
-			Path:  fmt.Sprintf("/spec/volumes/%d", index),
-			Value: volume,
-		}
-	}
+	})
 }
 
 // 为Volumes添加日志目录的空目录
-func addLogFileDirectoryVolume(index int) (patch patchOperation) {
-	volume := corev1.Volume{
+func addLogFileDirectoryVolume(pod *corev1.Pod) {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
 		Name: LogFileDirectory,
 		VolumeSource: corev1.VolumeSource{
 			EmptyDir: &corev1.EmptyDirVolumeSource{
 				Medium: "",
 			},
 		},
-	}
-	if index == 0 {
-		return patchOperation{
-			Op:    "add",
-			Path:  "/volumes",
-			Value: volume,
-		}
-	} else {
-		return patchOperation{
-			Op:    "add",
-			Path:  fmt.Sprintf("/spec/volumes/%d", index),
-			Value: volume,
-		}
-	}
+	})
 }
 
-// 为Pod添加添加prometheus注解
-func addPrometheusAnnotation(name string) (patch []patchOperation) {
+// 为Pod添加添加prometheus注解，annotations为预设配置中的注解，会覆盖默认值
+func addPrometheusAnnotation(pod *corev1.Pod, name string, annotations map[string]string) {
 	pMap := map[string]string{
 		PrometheusAPPInfoName:    name,
 		PrometheusAPPMetrics:     "true",
@@ -188,31 +207,17 @@ func addPrometheusAnnotation(name string) (patch []patchOperation) {
 		PrometheusAPPMetricsPort: "10900",
 		PrometheusScrape:         "true",
 	}
-	for k, v := range pMap {
-		patch = append(patch, patchOperation{
-			Op:    "add",
-			Path:  "/metadata/annotations/" + k,
-			Value: v,
-		})
+	for k, v := range annotations {
+		pMap[k] = v
 	}
-	return patch
-}
-
-// 为endpoint删除ip
-func deleteAddresses(addressesIndex, ipIndex int) (patch patchOperation) {
-	return patchOperation{
-		Op:   "remove",
-		Path: fmt.Sprintf("/subsets/%d/addresses/%d", addressesIndex, ipIndex),
+	for k, v := range pMap {
+		setAnnotation(&pod.ObjectMeta, k, v)
 	}
 }
 
-// 为endpoint删除ip
-func replaceAddresses(addresses []corev1.EndpointAddress, addressesIndex int) (patch patchOperation) {
-	return patchOperation{
-		Op:    "replace",
-		Path:  fmt.Sprintf("/subsets/%d/addresses", addressesIndex),
-		Value: addresses,
-	}
+// 替换endpoint中的ip
+func replaceAddresses(endpoint *corev1.Endpoints, addresses []corev1.EndpointAddress, addressesIndex int) {
+	endpoint.Subsets[addressesIndex].Addresses = addresses
 }
 
 // 检查IP地址是否合法
@@ -225,13 +230,52 @@ func CheckIp(ip string) bool {
 	return false
 }
 
+// IP地址族
+const (
+	IPv4 = "IPv4"
+	IPv6 = "IPv6"
+)
+
+// 检查IP地址是否合法并返回地址族，支持IPv4和IPv6，不合法时返回空
+func IPFamily(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	} else if parsed.To4() != nil {
+		return IPv4
+	}
+	return IPv6
+}
+
+// IP地址的标准格式，同一个IPv6地址可以有多种写法，比较前需要转换，不合法时原样返回
+func canonicalIP(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// 检查MAC地址是否合法并转换为标准格式，例如: 0a:58:0a:0a:0a:65，只支持48位的单播地址
+func canonicalMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return "", fmt.Errorf("invalid mac '%s'", mac)
+	}
+	if hw[0]&1 == 1 {
+		return "", fmt.Errorf("mac %s is not a unicast address", mac)
+	}
+	return hw.String(), nil
+}
+
 // 检查Port是否合法
 func CheckPort(port string) bool {
-	regStr := `^([1-9]|[1-9]\d{1,3}|[1-5]\d{4}|6[0-5]{2}[0-3][0-5])$`
-	if match, _ := regexp.MatchString(regStr, port); match {
-		return true
+	regStr := `^[1-9]\d{0,4}$`
+	if match, _ := regexp.MatchString(regStr, port); !match {
+		return false
 	}
-	return false
+	// 正则只校验格式，范围为1-65535
+	p, err := strconv.Atoi(port)
+	return err == nil && p <= 65535
 }
 
 // slice item 重复检查
@@ -3,19 +3,65 @@ package impl
 import "testing"
 
 func TestCheckPort(t *testing.T) {
-	port := []string{"80", "0", "200", "3000", "45678", "70000", "test", " 10", "bb "}
-	for _, p := range port {
+	valid := []string{"80", "200", "3000", "45678", "60009", "65535"}
+	for _, p := range valid {
 		if !CheckPort(p) {
-			t.Error(p, "false")
+			t.Error(p, "expected valid")
+		}
+	}
+	invalid := []string{"0", "070", "65536", "70000", "test", " 10", "bb ", ""}
+	for _, p := range invalid {
+		if CheckPort(p) {
+			t.Error(p, "expected invalid")
 		}
 	}
 }
 
 func TestCheckIp(t *testing.T) {
-	port := []string{"10.10.1.2555", "2555.10.10.1", "20.20", "aa.bb", "192.168.10.10", " 8.8.8.8", "10.13.88.10"}
-	for _, p := range port {
+	valid := []string{"192.168.10.10", "10.13.88.10", "8.8.8.8"}
+	for _, p := range valid {
 		if !CheckIp(p) {
-			t.Error(p, "false")
+			t.Error(p, "expected valid")
+		}
+	}
+	invalid := []string{"10.10.1.2555", "2555.10.10.1", "20.20", "aa.bb", " 8.8.8.8"}
+	for _, p := range invalid {
+		if CheckIp(p) {
+			t.Error(p, "expected invalid")
+		}
+	}
+}
+
+func TestIPFamily(t *testing.T) {
+	for ip, family := range map[string]string{
+		"10.10.10.101":     IPv4,
+		"fd00:10::101":     IPv6,
+		"fd00:10:0:0::101": IPv6,
+		"10.10.10.256":     "",
+		"fd00::10::101":    "",
+		" 8.8.8.8":         "",
+	} {
+		if got := IPFamily(ip); got != family {
+			t.Errorf("IPFamily(%q) = %q, want %q", ip, got, family)
+		}
+	}
+	if ip := canonicalIP("fd00:10:0:0::101"); ip != "fd00:10::101" {
+		t.Errorf("canonicalIP = %s, want fd00:10::101", ip)
+	}
+}
+
+func TestCanonicalMAC(t *testing.T) {
+	for mac, want := range map[string]string{
+		"0a:58:0a:0a:0a:65": "0a:58:0a:0a:0a:65",
+		"0A-58-0A-0A-0A-65": "0a:58:0a:0a:0a:65",
+		"0a58.0a0a.0a65":    "0a:58:0a:0a:0a:65",
+		"01:00:5e:00:00:01": "",
+		"0a:58:0a:0a:0a":    "",
+		"00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01": "",
+	} {
+		got, err := canonicalMAC(mac)
+		if got != want || (want == "") != (err != nil) {
+			t.Errorf("canonicalMAC(%q) = %q %v, want %q", mac, got, err, want)
 		}
 	}
 }
@@ -23,11 +69,11 @@ func TestCheckIp(t *testing.T) {
 func TestCheckDuplicate(t *testing.T) {
 	list := []string{"a", "a", "b", "b"}
 	list1 := []string{"a", "b", "c", "d"}
-	if !CheckNotDuplicate(list) {
-		t.Error(list, "false")
+	if CheckNotDuplicate(list) {
+		t.Error(list, "expected duplicate")
 	}
 	if !CheckNotDuplicate(list1) {
-		t.Error(list1, "false")
+		t.Error(list1, "expected not duplicate")
 	}
 }
 
@@ -35,11 +81,11 @@ func TestEqualSlice(t *testing.T) {
 	list := []string{"a", "b", "c"}
 	list1 := []string{"a", "b", "c"}
 	if !EqualSlice(list, list1) {
-		t.Error("false")
+		t.Error("expected equal")
 	}
 	list2 := []string{"a", "b", "c"}
 	list3 := []string{"a", "b", "d"}
-	if !EqualSlice(list2, list3) {
-		t.Error("false")
+	if EqualSlice(list2, list3) {
+		t.Error("expected not equal")
 	}
 }
@@ -0,0 +1,292 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/log"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// WebhookSpec 预设在Mutating/ValidatingWebhookConfiguration中的配置
+type WebhookSpec struct {
+	Name                string                                  // webhook名称，例如: fix.pod.ip
+	ObjectSelector      *metav1.LabelSelector                   // 只有匹配的资源才会发送到king-preset
+	MutateOperations    []admissionregistrationv1.OperationType // mutate关注的操作
+	ValidateOperations  []admissionregistrationv1.OperationType // validate关注的操作
+	MutateSideEffects   admissionregistrationv1.SideEffectClass // mutate是否有副作用，默认为None
+	ValidateSideEffects admissionregistrationv1.SideEffectClass // validate是否有副作用，默认为None
+	// API Server调用king-preset失败（超时、无法连接）时的处理策略，默认为Ignore，与v1beta1的默认值一致
+	FailurePolicy admissionregistrationv1.FailurePolicyType
+	// API Server调用king-preset的超时时间，默认为30秒，与v1beta1的默认值一致
+	TimeoutSeconds int32
+}
+
+// 与admissionregistration v1beta1一致的默认值，v1的默认值为Fail和10秒
+const (
+	DefaultFailurePolicy  = admissionregistrationv1.Ignore
+	DefaultTimeoutSeconds = int32(30)
+)
+
+// 资源类型对应的webhook规则，预设的MutateKinds和ValidateKinds必须在此列表中
+var kindRules = map[string]admissionregistrationv1.Rule{
+	"Pod":         {APIGroups: []string{""}, APIVersions: []string{"v1"}, Resources: []string{"pods"}},
+	"Service":     {APIGroups: []string{""}, APIVersions: []string{"v1"}, Resources: []string{"services"}},
+	"Endpoints":   {APIGroups: []string{""}, APIVersions: []string{"v1"}, Resources: []string{"endpoints"}},
+	"Deployment":  {APIGroups: []string{"apps"}, APIVersions: []string{"v1"}, Resources: []string{"deployments"}},
+	"ReplicaSet":  {APIGroups: []string{"apps"}, APIVersions: []string{"v1"}, Resources: []string{"replicasets"}},
+	"StatefulSet": {APIGroups: []string{"apps"}, APIVersions: []string{"v1"}, Resources: []string{"statefulsets"}},
+	"Scale":       {APIGroups: []string{"apps"}, APIVersions: []string{"v1"}, Resources: []string{"statefulsets/scale"}},
+}
+
+// 没有标签的资源（子资源），ObjectSelector无法匹配，单独注册不带ObjectSelector的validate webhook
+// webhook名称为<前缀>.<预设webhook名称>，由预设自行判断父资源是否开启
+var unlabeledKinds = map[string]string{"Scale": "scale"}
+
+// 不带ObjectSelector的webhook会拦截集群中所有此类请求，不处理系统命名空间
+// kubernetes.io/metadata.name标签由1.21及以上版本自动添加，低版本没有此标签时不排除
+var systemNamespaceSelector = &metav1.LabelSelector{
+	MatchExpressions: []metav1.LabelSelectorRequirement{{
+		Key:      "kubernetes.io/metadata.name",
+		Operator: metav1.LabelSelectorOpNotIn,
+		Values:   []string{"kube-system", "kube-public", "kube-node-lease"},
+	}},
+}
+
+// WebhookOptions 生成Webhook配置所需的Service信息
+type WebhookOptions struct {
+	Name      string // Mutating/ValidatingWebhookConfiguration的名称
+	Service   string
+	Namespace string
+	Port      int32
+	CABundle  []byte // 为空时保留集群中已有的caBundle
+}
+
+// PresetRoute 预设的路由路径，router和Webhook配置都使用此路径
+func PresetRoute(action string, preset Preset) string {
+	return common.PresetPath + action + "/" + preset.Path()
+}
+
+// BuildWebhookConfigurations 根据已注册的预设生成Mutating/ValidatingWebhookConfiguration
+func BuildWebhookConfigurations(opts WebhookOptions) (*admissionregistrationv1.MutatingWebhookConfiguration, *admissionregistrationv1.ValidatingWebhookConfiguration, error) {
+	mutating := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: opts.Name, Labels: map[string]string{"app": opts.Service}},
+	}
+	validating := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: opts.Name, Labels: map[string]string{"app": opts.Service}},
+	}
+	none := admissionregistrationv1.SideEffectClassNone
+	// 不带ObjectSelector的webhook总是使用Ignore，king-preset不可用时不能阻塞集群中所有的扩缩容
+	ignore, timeout := admissionregistrationv1.Ignore, DefaultTimeoutSeconds
+	var unlabeledWebhooks []admissionregistrationv1.ValidatingWebhook
+	for _, preset := range presets {
+		spec := preset.Webhook()
+		mutateRules, err := buildRules(preset.MutateKinds(), spec.MutateOperations)
+		if err != nil {
+			return nil, nil, fmt.Errorf("preset %s: %v", preset.Name(), err)
+		}
+		validateKinds := preset.ValidateKinds()
+		if spec.ObjectSelector != nil {
+			validateKinds = nil
+			for _, kind := range preset.ValidateKinds() {
+				prefix, ok := unlabeledKinds[kind]
+				if !ok {
+					validateKinds = append(validateKinds, kind)
+					continue
+				}
+				rules, err := buildRules([]string{kind}, []admissionregistrationv1.OperationType{admissionregistrationv1.Update})
+				if err != nil {
+					return nil, nil, fmt.Errorf("preset %s: %v", preset.Name(), err)
+				}
+				unlabeledWebhooks = append(unlabeledWebhooks, admissionregistrationv1.ValidatingWebhook{
+					Name:                    prefix + "." + spec.Name,
+					ClientConfig:            clientConfig(opts, PresetRoute(ValidateAction, preset)),
+					Rules:                   rules,
+					NamespaceSelector:       systemNamespaceSelector,
+					SideEffects:             &none,
+					FailurePolicy:           &ignore,
+					TimeoutSeconds:          &timeout,
+					AdmissionReviewVersions: []string{"v1", "v1beta1"},
+				})
+			}
+		}
+		validateRules, err := buildRules(validateKinds, spec.ValidateOperations)
+		if err != nil {
+			return nil, nil, fmt.Errorf("preset %s: %v", preset.Name(), err)
+		}
+		mutateSideEffects := spec.MutateSideEffects
+		if mutateSideEffects == "" {
+			mutateSideEffects = none
+		}
+		validateSideEffects := spec.ValidateSideEffects
+		if validateSideEffects == "" {
+			validateSideEffects = none
+		}
+		failurePolicy := spec.FailurePolicy
+		if failurePolicy == "" {
+			failurePolicy = DefaultFailurePolicy
+		}
+		timeoutSeconds := spec.TimeoutSeconds
+		if timeoutSeconds == 0 {
+			timeoutSeconds = DefaultTimeoutSeconds
+		}
+		if len(mutateRules) != 0 {
+			mutating.Webhooks = append(mutating.Webhooks, admissionregistrationv1.MutatingWebhook{
+				Name:                    spec.Name,
+				ClientConfig:            clientConfig(opts, PresetRoute(MutateAction, preset)),
+				Rules:                   mutateRules,
+				ObjectSelector:          spec.ObjectSelector,
+				SideEffects:             &mutateSideEffects,
+				FailurePolicy:           &failurePolicy,
+				TimeoutSeconds:          &timeoutSeconds,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			})
+		}
+		if len(validateRules) != 0 {
+			validating.Webhooks = append(validating.Webhooks, admissionregistrationv1.ValidatingWebhook{
+				Name:                    spec.Name,
+				ClientConfig:            clientConfig(opts, PresetRoute(ValidateAction, preset)),
+				Rules:                   validateRules,
+				ObjectSelector:          spec.ObjectSelector,
+				SideEffects:             &validateSideEffects,
+				FailurePolicy:           &failurePolicy,
+				TimeoutSeconds:          &timeoutSeconds,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			})
+		}
+	}
+	validating.Webhooks = append(validating.Webhooks, unlabeledWebhooks...)
+	return mutating, validating, nil
+}
+
+// RegisterWebhooks 创建或更新king-preset的Mutating/ValidatingWebhookConfiguration
+func RegisterWebhooks(client kubernetes.Interface, opts WebhookOptions) error {
+	mutating, validating, err := BuildWebhookConfigurations(opts)
+	if err != nil {
+		return err
+	}
+	// 没有指定caBundle时使用集群中已有的caBundle，新增的webhook（例如升级后新增的scale.fix.pod.ip）使用已有的任意一个
+	var fallback []byte
+	if len(opts.CABundle) == 0 {
+		if fallback, err = existingCABundle(client, opts.Name); err != nil {
+			return err
+		}
+		for i := range mutating.Webhooks {
+			mutating.Webhooks[i].ClientConfig.CABundle = fallback
+		}
+		for i := range validating.Webhooks {
+			validating.Webhooks[i].ClientConfig.CABundle = fallback
+		}
+	}
+	mutatingClient := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := mutatingClient.Get(context.TODO(), opts.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			_, err = mutatingClient.Create(context.TODO(), mutating, metav1.CreateOptions{})
+			return err
+		} else if err != nil {
+			return err
+		}
+		caBundles := make(map[string][]byte)
+		for _, webhook := range existing.Webhooks {
+			caBundles[webhook.Name] = webhook.ClientConfig.CABundle
+		}
+		for i := range mutating.Webhooks {
+			if caBundle := caBundles[mutating.Webhooks[i].Name]; len(opts.CABundle) == 0 && len(caBundle) != 0 {
+				mutating.Webhooks[i].ClientConfig.CABundle = caBundle
+			}
+		}
+		existing.Labels = mutating.Labels
+		existing.Webhooks = mutating.Webhooks
+		_, err = mutatingClient.Update(context.TODO(), existing, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("register MutatingWebhookConfiguration %s error: %v", opts.Name, err)
+	}
+	validatingClient := client.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := validatingClient.Get(context.TODO(), opts.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			_, err = validatingClient.Create(context.TODO(), validating, metav1.CreateOptions{})
+			return err
+		} else if err != nil {
+			return err
+		}
+		caBundles := make(map[string][]byte)
+		for _, webhook := range existing.Webhooks {
+			caBundles[webhook.Name] = webhook.ClientConfig.CABundle
+		}
+		for i := range validating.Webhooks {
+			if caBundle := caBundles[validating.Webhooks[i].Name]; len(opts.CABundle) == 0 && len(caBundle) != 0 {
+				validating.Webhooks[i].ClientConfig.CABundle = caBundle
+			}
+		}
+		existing.Labels = validating.Labels
+		existing.Webhooks = validating.Webhooks
+		_, err = validatingClient.Update(context.TODO(), existing, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("register ValidatingWebhookConfiguration %s error: %v", opts.Name, err)
+	}
+	log.Infof("Register webhook configuration %s: %d mutating, %d validating webhooks", opts.Name, len(mutating.Webhooks), len(validating.Webhooks))
+	return nil
+}
+
+// 集群中已有的Mutating/ValidatingWebhookConfiguration中任意一个非空的caBundle
+// 都没有时返回错误，caBundle为空的webhook会导致API Server调用时TLS校验失败
+func existingCABundle(client kubernetes.Interface, name string) ([]byte, error) {
+	mutating, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	} else if err == nil {
+		for _, webhook := range mutating.Webhooks {
+			if len(webhook.ClientConfig.CABundle) != 0 {
+				return webhook.ClientConfig.CABundle, nil
+			}
+		}
+	}
+	validating, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	} else if err == nil {
+		for _, webhook := range validating.Webhooks {
+			if len(webhook.ClientConfig.CABundle) != 0 {
+				return webhook.ClientConfig.CABundle, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no caBundle in webhook configuration %s, use --self-signed-cert or set the caBundle before registering", name)
+}
+
+func buildRules(kinds []string, operations []admissionregistrationv1.OperationType) ([]admissionregistrationv1.RuleWithOperations, error) {
+	var rules []admissionregistrationv1.RuleWithOperations
+	for _, kind := range kinds {
+		rule, ok := kindRules[kind]
+		if !ok {
+			return nil, fmt.Errorf("no webhook rule for kind '%s'", kind)
+		}
+		rules = append(rules, admissionregistrationv1.RuleWithOperations{
+			Operations: operations,
+			Rule:       rule,
+		})
+	}
+	return rules, nil
+}
+
+func clientConfig(opts WebhookOptions, path string) admissionregistrationv1.WebhookClientConfig {
+	return admissionregistrationv1.WebhookClientConfig{
+		Service: &admissionregistrationv1.ServiceReference{
+			Name:      opts.Service,
+			Namespace: opts.Namespace,
+			Path:      &path,
+			Port:      &opts.Port,
+		},
+		CABundle: opts.CABundle,
+	}
+}
@@ -0,0 +1,92 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestBuildWebhookConfigurations(t *testing.T) {
+	opts := WebhookOptions{Name: "king-preset", Service: "king-preset", Namespace: "kingfisher-system", Port: 443}
+	mutating, validating, err := BuildWebhookConfigurations(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fix-pod-ip额外注册scale子资源的webhook
+	if len(mutating.Webhooks) != len(Presets()) || len(validating.Webhooks) != len(Presets())+1 {
+		t.Fatalf("expected %d webhooks, got %d mutating and %d validating", len(Presets()), len(mutating.Webhooks), len(validating.Webhooks))
+	}
+	if scale := validating.Webhooks[len(Presets())]; scale.Name != "scale.fix.pod.ip" || scale.ObjectSelector != nil {
+		t.Errorf("scale webhook: got %s with objectSelector %v", scale.Name, scale.ObjectSelector)
+	} else if scale.FailurePolicy == nil || *scale.FailurePolicy != admissionregistrationv1.Ignore || scale.NamespaceSelector == nil {
+		t.Errorf("scale webhook: expected failurePolicy Ignore and a namespaceSelector, got %v %v", scale.FailurePolicy, scale.NamespaceSelector)
+	}
+	for i, preset := range Presets() {
+		if path := *mutating.Webhooks[i].ClientConfig.Service.Path; path != PresetRoute(MutateAction, preset) {
+			t.Errorf("%s: mutate path %s does not match router", preset.Name(), path)
+		}
+		if path := *validating.Webhooks[i].ClientConfig.Service.Path; path != PresetRoute(ValidateAction, preset) {
+			t.Errorf("%s: validate path %s does not match router", preset.Name(), path)
+		}
+		if len(mutating.Webhooks[i].Rules) != len(preset.MutateKinds()) {
+			t.Errorf("%s: expected %d mutate rules, got %d", preset.Name(), len(preset.MutateKinds()), len(mutating.Webhooks[i].Rules))
+		}
+		if mutating.Webhooks[i].ObjectSelector == nil {
+			t.Errorf("%s: objectSelector is not set", preset.Name())
+		}
+		// 与v1beta1一致，默认为Ignore和30秒
+		for _, webhook := range []struct {
+			failurePolicy  *admissionregistrationv1.FailurePolicyType
+			timeoutSeconds *int32
+		}{
+			{mutating.Webhooks[i].FailurePolicy, mutating.Webhooks[i].TimeoutSeconds},
+			{validating.Webhooks[i].FailurePolicy, validating.Webhooks[i].TimeoutSeconds},
+		} {
+			if webhook.failurePolicy == nil || *webhook.failurePolicy != admissionregistrationv1.Ignore || webhook.timeoutSeconds == nil || *webhook.timeoutSeconds != 30 {
+				t.Errorf("%s: expected failurePolicy Ignore and timeout 30s", preset.Name())
+			}
+		}
+	}
+}
+
+func TestRegisterWebhooksKeepCABundle(t *testing.T) {
+	opts := WebhookOptions{Name: "king-preset", Service: "king-preset", Namespace: "kingfisher-system", Port: 443}
+	caBundle := []byte("ca")
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: opts.Name},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name:         "fix.pod.ip",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: caBundle},
+		}},
+	})
+	if err := RegisterWebhooks(client, opts); err != nil {
+		t.Fatal(err)
+	}
+	mutating, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), opts.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, webhook := range mutating.Webhooks {
+		if !bytes.Equal(webhook.ClientConfig.CABundle, caBundle) {
+			t.Errorf("%s: existing caBundle was not preserved", webhook.Name)
+		}
+	}
+	validating, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.TODO(), opts.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("ValidatingWebhookConfiguration not created: %v", err)
+	}
+	// 新增的webhook（例如scale.fix.pod.ip）使用已有的caBundle
+	for _, webhook := range validating.Webhooks {
+		if !bytes.Equal(webhook.ClientConfig.CABundle, caBundle) {
+			t.Errorf("%s: caBundle is not set", webhook.Name)
+		}
+	}
+
+	// 集群中没有caBundle时不注册
+	if err := RegisterWebhooks(fake.NewSimpleClientset(), opts); err == nil {
+		t.Error("register without any caBundle should fail")
+	}
+}
@@ -1,23 +1,169 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-preset/cert"
+	"github.com/open-kingfisher/king-preset/conf"
+	"github.com/open-kingfisher/king-preset/impl"
 	"github.com/open-kingfisher/king-preset/router"
 	"github.com/open-kingfisher/king-utils/common/log"
 	"github.com/open-kingfisher/king-utils/config"
 	"github.com/open-kingfisher/king-utils/kit"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+var (
+	metricsAddr       = flag.String("metrics-addr", ":8080", "Plain HTTP listen address of the /metrics endpoint")
+	selfSignedCert    = flag.Bool("self-signed-cert", false, "Generate a self-signed CA and serving certificate, store them in a secret and patch the caBundle of the webhook configurations")
+	serviceName       = flag.String("service-name", "king-preset", "Service name of the webhook")
+	serviceNamespace  = flag.String("service-namespace", defaultNamespace(), "Namespace of the webhook service, defaults to $POD_NAMESPACE")
+	certSecret        = flag.String("cert-secret", "king-preset-ca", "Secret to store the self-signed certificates, must not be the TLS secret created by deployment.sh")
+	webhookConfigName = flag.String("webhook-config-name", "king-preset", "Name of the Mutating/ValidatingWebhookConfiguration")
+	configFlags       = conf.AddFlags(flag.CommandLine)
+	presetConfigMap   = flag.String("preset-config-map", "king-preset-config", "ConfigMap in the service namespace to watch for dynamic preset config, empty to disable")
+	kubeconfig        = flag.String("kubeconfig", "", "Path to a kubeconfig for running out of cluster, defaults to $KUBECONFIG and then the in-cluster config")
+	kubeContext       = flag.String("context", "", "Kubeconfig context to use, defaults to the current context")
+	dryRunClient      = flag.Bool("dry-run-client", false, "Use an in-memory fake clientset instead of a cluster, for local development")
+	verifyPatches     = flag.Bool("verify-patches", false, "Apply every JSON patch to the original object before responding and treat failures as internal errors")
+	registerWebhooks  = flag.Bool("register-webhooks", true, "Create or update the Mutating/ValidatingWebhookConfiguration from the registered presets, disable it for GitOps setups")
 )
 
 func main() {
+	// 离线评估子命令: king-preset eval -f pod.yaml
+	if len(os.Args) > 1 && os.Args[1] == "eval" {
+		os.Exit(runEval(os.Args[2:]))
+	}
+	flag.Parse()
+	// 合并配置文件、环境变量和命令行参数，配置不合法时直接退出
+	cfg, err := configFlags.Load(flag.CommandLine)
+	if err != nil {
+		log.Fatalf("Load config error: %v", err)
+	}
+	impl.SetClientOptions(impl.ClientOptions{Kubeconfig: *kubeconfig, Context: *kubeContext, DryRun: *dryRunClient})
+	setLogSidecarConfig(cfg)
+	cert.CertFile, cert.KeyFile = filepath.Join(cfg.CertDir, cert.CertName), filepath.Join(cfg.CertDir, cert.KeyName)
+	// 预设内部错误时的处理策略，默认fail-closed
+	if err := impl.SetFailurePolicies(cfg.FailurePolicy); err != nil {
+		log.Fatalf("Failure policy error: %v", err)
+	}
+	// 监听预设配置ConfigMap，修改后立即生效
+	if *presetConfigMap != "" {
+		clientSet, err := impl.K8SClient()
+		if err != nil {
+			log.Fatalf("Get clientSet error: %v", err)
+		}
+		if err := impl.WatchPresetConfig(clientSet, *serviceNamespace, *presetConfigMap, wait.NeverStop); err != nil {
+			log.Fatalf("Watch preset config error: %v", err)
+		}
+	}
+	impl.SetVerifyPatches(*verifyPatches)
+	// Prometheus监控数据，单独使用HTTP端口
+	go serveMetrics(*metricsAddr)
 	// Debug Mode
 	gin.SetMode(config.Mode)
 	g := gin.New()
 	// 设置路由
 	r := router.SetupRouter(kit.EnhanceGin(g))
-	// Listen and Server in 0.0.0.0:443
-	// tls.crt 和 tls.key 采用secret的方式挂载
-	log.Info("Listen 443")
-	if err := r.RunTLS(":443", "/etc/webhook/certs/tls.crt", "/etc/webhook/certs/tls.key"); err != nil {
-		log.Fatalf("Listen error: %v", err)
+	// 自签名证书写入本地目录，并定期检查是否需要更新
+	var caBundle []byte
+	if *selfSignedCert {
+		clientSet, err := impl.K8SClient()
+		if err != nil {
+			log.Fatalf("Get clientSet error: %v", err)
+		}
+		manager := cert.NewManager(clientSet, cert.Options{
+			Service:           *serviceName,
+			Namespace:         *serviceNamespace,
+			SecretName:        *certSecret,
+			WebhookConfigName: *webhookConfigName,
+			Dir:               cert.SelfSignedDir,
+		})
+		if err := manager.Ensure(); err != nil {
+			log.Fatalf("Self-signed certificate error: %v", err)
+		}
+		go manager.Run(wait.NeverStop)
+		cert.CertFile, cert.KeyFile = manager.CertFile(), manager.KeyFile()
+		caBundle = manager.CABundle()
+	}
+	// 根据已注册的预设创建或更新Webhook配置
+	if *registerWebhooks {
+		clientSet, err := impl.K8SClient()
+		if err != nil {
+			log.Fatalf("Get clientSet error: %v", err)
+		}
+		if err := impl.RegisterWebhooks(clientSet, impl.WebhookOptions{
+			Name:      *webhookConfigName,
+			Service:   *serviceName,
+			Namespace: *serviceNamespace,
+			Port:      443,
+			CABundle:  caBundle,
+		}); err != nil {
+			log.Fatalf("Register webhooks error: %v", err)
+		}
+	}
+	// tls.crt 和 tls.key 采用secret的方式挂载，secret更新后自动重新加载证书
+	watcher, err := cert.NewWatcher(cert.CertFile, cert.KeyFile)
+	if err != nil {
+		log.Fatalf("Load certificate error: %v", err)
+	}
+	go watcher.Run(wait.NeverStop)
+	server := &http.Server{
+		Addr:      cfg.ListenAddr,
+		Handler:   r,
+		TLSConfig: &tls.Config{GetCertificate: watcher.GetCertificate},
+	}
+	// 先监听端口，大集群中informer首次同步耗时较长，同步完成之前存活检查正常，就绪检查失败
+	go func() {
+		log.Infof("Listen %s", cfg.ListenAddr)
+		if err := server.ListenAndServeTLS("", ""); err != nil {
+			log.Fatalf("Listen error: %v", err)
+		}
+	}()
+	// 启动informer，准入请求中的资源查询使用本地缓存
+	if err := impl.StartInformers(wait.NeverStop); err != nil {
+		log.Fatalf("Start informers error: %v", err)
+	}
+	// 绑定和释放fix-pod-ip IP池的租约
+	if err := impl.StartIPPoolController(wait.NeverStop); err != nil {
+		log.Fatalf("Start ip pool controller error: %v", err)
+	}
+	// 检查fix-pod-ip的IP冲突
+	if err := impl.StartFixPodIPInformers(wait.NeverStop); err != nil {
+		log.Fatalf("Start ip conflict informers error: %v", err)
+	}
+	impl.SetInformersSynced()
+	log.Info("Informer caches synced")
+	<-wait.NeverStop
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("Metrics listen %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Metrics listen error: %v", err)
+	}
+}
+
+func setLogSidecarConfig(cfg *conf.Config) {
+	impl.SetLogSidecarConfig(impl.LogSidecarConfig{
+		Image:                 cfg.SidecarImage,
+		PullPolicy:            corev1.PullPolicy(cfg.SidecarPullPolicy),
+		DefaultMetricInterval: cfg.DefaultMetricInterval,
+		DefaultLogDirectory:   cfg.DefaultLogDirectory,
+	})
+}
+
+func defaultNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
 	}
+	return "kingfisher-system"
 }
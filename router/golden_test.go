@@ -0,0 +1,190 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-preset/impl"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"io/ioutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// go test ./router -update 重新生成golden文件
+var update = flag.Bool("update", false, "update golden files in testdata/golden")
+
+// 测试用例，testdata/cases下的每个文件是一个用例
+type goldenCase struct {
+	Path    string          `json:"path"`    // 请求路径，不带PresetPath前缀，例如: mutate/fixpodip
+	Review  json.RawMessage `json:"review"`  // AdmissionReview
+	RawBody string          `json:"rawBody"` // 原始请求体，用于测试无法解析的请求
+}
+
+// golden文件内容
+type goldenResult struct {
+	Code     int                    `json:"code"`
+	Response map[string]interface{} `json:"response"`
+	Patch    []interface{}          `json:"patch,omitempty"`   // 解码后的JSONPatch
+	Patched  map[string]interface{} `json:"patched,omitempty"` // 应用JSONPatch之后的资源
+	PatchErr string                 `json:"patchError,omitempty"`
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	gin.SetMode(gin.TestMode)
+	log.SetLoggerLevel("fatal")
+	// 日志sidecar预设会创建和删除ConfigMap
+	// fix-pod-ip预设检查IP是否被其他工作负载和Pod使用
+	impl.SetK8SClient(fake.NewSimpleClientset(
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "cache", Namespace: "app", Labels: map[string]string{"fix-pod-ip": "enabled"}},
+			Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{"fix.pod.ip": `[{"node03":["10.10.10.150"]}]`},
+			}}},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: "default"},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.10.10.160"},
+		},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node01"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node02"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node03"}},
+	))
+	// fix-pod-ip预设从FixedIPPool中租用IP，检查IP是否在Calico IPPool中
+	impl.SetDynamicClient(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "crd.projectcalico.org/v1",
+		"kind":       "IPPool",
+		"metadata":   map[string]interface{}{"name": "default-ipv4-ippool"},
+		"spec":       map[string]interface{}{"cidr": "10.10.0.0/16"},
+	}}, &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "crd.projectcalico.org/v1",
+		"kind":       "IPPool",
+		"metadata":   map[string]interface{}{"name": "default-ipv6-ippool"},
+		"spec":       map[string]interface{}{"cidr": "fd00:10::/64"},
+	}}, &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "preset.kingfisher.io/v1alpha1",
+		"kind":       "FixedIPPool",
+		"metadata":   map[string]interface{}{"name": "db", "namespace": "app"},
+		"spec": map[string]interface{}{
+			"ips": []interface{}{
+				map[string]interface{}{"ip": "10.10.20.11", "node": "node01"},
+				map[string]interface{}{"ip": "10.10.20.12", "node": "node02"},
+			},
+		},
+	}}))
+	// FixedIPPool中的IP也不能被其他工作负载使用，dynamic client需要在informer启动之前设置
+	if err := impl.StartFixPodIPInformers(make(chan struct{})); err != nil {
+		panic(err)
+	}
+	impl.SetVerifyPatches(true)
+	os.Exit(m.Run())
+}
+
+func TestGolden(t *testing.T) {
+	router := SetupRouter(gin.New())
+	files, err := filepath.Glob(filepath.Join("testdata", "cases", "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no test cases in testdata/cases")
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".yaml")
+		t.Run(name, func(t *testing.T) {
+			got, err := runCase(router, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			goldenFile := filepath.Join("testdata", "golden", name+".yaml")
+			if *update {
+				if err := ioutil.WriteFile(goldenFile, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(goldenFile)
+			if err != nil {
+				t.Fatalf("read golden file, run with -update to create it: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("response does not match %s, run with -update if the change is expected\ngot:\n%s\nwant:\n%s", goldenFile, got, want)
+			}
+		})
+	}
+}
+
+func runCase(router http.Handler, file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var c goldenCase
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("parse case %s error: %v", file, err)
+	}
+	body := []byte(c.RawBody)
+	if c.RawBody == "" {
+		body = c.Review
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, common.PresetPath+c.Path, bytes.NewReader(body)))
+
+	result := goldenResult{Code: w.Code}
+	if err := json.Unmarshal(w.Body.Bytes(), &result.Response); err != nil {
+		return nil, fmt.Errorf("response is not JSON: %v: %s", err, w.Body.String())
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+		return nil, err
+	}
+	if review.Response != nil && len(review.Response.Patch) != 0 {
+		// patch在响应中为base64，golden文件中保存解码后的内容以及应用后的资源
+		delete(result.Response["response"].(map[string]interface{}), "patch")
+		if err := json.Unmarshal(review.Response.Patch, &result.Patch); err != nil {
+			return nil, err
+		}
+		// 不同字段的patch顺序不固定，按路径排序后保存，应用时使用原始顺序
+		sort.SliceStable(result.Patch, func(i, j int) bool {
+			return result.Patch[i].(map[string]interface{})["path"].(string) < result.Patch[j].(map[string]interface{})["path"].(string)
+		})
+		var request admissionv1.AdmissionReview
+		if err := json.Unmarshal(c.Review, &request); err != nil {
+			return nil, err
+		}
+		patched, err := applyPatch(review.Response.Patch, request.Request.Object.Raw)
+		if err != nil {
+			result.PatchErr = err.Error()
+		} else if err := json.Unmarshal(patched, &result.Patched); err != nil {
+			return nil, err
+		}
+	}
+	return yaml.Marshal(result)
+}
+
+func applyPatch(patch, raw []byte) ([]byte, error) {
+	decoded, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	return decoded.Apply(raw)
+}
@@ -0,0 +1,41 @@
+package router
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-preset/cert"
+	"github.com/open-kingfisher/king-preset/impl"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"net/http"
+)
+
+// 就绪检查项，名称对应检查函数
+var readyChecks = []struct {
+	name  string
+	check func() error
+}{
+	{"certificate", cert.Ready},
+	{"apiserver", impl.CheckAPIServer},
+	{"informers", impl.CheckInformersSynced},
+}
+
+// 存活检查
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, common.ResponseData{Code: http.StatusOK, Msg: "ok"})
+}
+
+// 就绪检查: 证书可以加载且未过期，可以访问API Server，并且informer缓存已经同步
+func Readyz(c *gin.Context) {
+	failures := make(map[string]string)
+	for _, item := range readyChecks {
+		if err := item.check(); err != nil {
+			log.Errorf("Readiness check %s failed: %v", item.name, err)
+			failures[item.name] = err.Error()
+		}
+	}
+	if len(failures) != 0 {
+		c.JSON(http.StatusServiceUnavailable, common.ResponseData{Code: http.StatusServiceUnavailable, Data: failures, Msg: "not ready"})
+		return
+	}
+	c.JSON(http.StatusOK, common.ResponseData{Code: http.StatusOK, Msg: "ok"})
+}
@@ -11,15 +11,14 @@ func SetupRouter(r *gin.Engine) *gin.Engine {
 
 	//重新定义404
 	r.NoRoute(NoRoute)
-	// Pod IP 地址固定
-	r.POST(common.PresetPath+"mutate/fixpodip", impl.MutateFixPodIP)
-	r.POST(common.PresetPath+"validate/fixpodip", impl.ValidateFixPodIP)
-	// EndPoint Extend
-	r.POST(common.PresetPath+"mutate/endpointextendip", impl.MutateEndpointExtendIp)
-	r.POST(common.PresetPath+"validate/endpointextendip", impl.ValidateEndpointExtendIp)
-	// Inject Log Sidecar
-	r.POST(common.PresetPath+"mutate/log", impl.MutateInjectLogSidecar)
-	r.POST(common.PresetPath+"validate/log", impl.ValidateInjectLogSidecar)
+	// 存活和就绪检查
+	r.GET("/healthz", Healthz)
+	r.GET("/readyz", Readyz)
+	// 根据注册的预设挂载路由，例如: Pod IP 地址固定 mutate/fixpodip validate/fixpodip
+	for _, preset := range impl.Presets() {
+		r.POST(impl.PresetRoute(impl.MutateAction, preset), impl.MutateHandler(preset))
+		r.POST(impl.PresetRoute(impl.ValidateAction, preset), impl.ValidateHandler(preset))
+	}
 
 	return r
 }